@@ -0,0 +1,430 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mc0239/kumuluzee-go-discovery/discovery"
+)
+
+// creates flag set of a command, parse errors are returned to be handled by run()
+func newFlagSet(name, arguments string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kumuluzee-discovery %s %s\n", name, arguments)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errUsage
+	}
+	return nil
+}
+
+// prints usage and returns errUsage if any of required flag values is empty
+func requireFlags(fs *flag.FlagSet, names ...string) error {
+	for _, name := range names {
+		if fs.Lookup(name).Value.String() == "" {
+			fmt.Fprintf(fs.Output(), "flag -%s is required\n", name)
+			fs.Usage()
+			return errUsage
+		}
+	}
+	return nil
+}
+
+func list(c cli, args []string) error {
+	fs := newFlagSet("list", "envs|services|versions|instances [flags]")
+	env := fs.String("env", "", "environment (default: all environments)")
+	service := fs.String("service", "", "service name (default: all services)")
+	asJSON := fs.Bool("json", false, "print JSON")
+
+	if len(args) == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	what := args[0]
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+
+	instances, err := c.discovery().ListInstances(*env, *service)
+	if err != nil {
+		return err
+	}
+
+	switch what {
+	case "envs":
+		return printRows(*asJSON, []string{"ENVIRONMENT", "INSTANCES"}, groupInstances(instances, func(i discovery.Instance) []string {
+			return []string{i.Environment}
+		}))
+	case "services":
+		return printRows(*asJSON, []string{"ENVIRONMENT", "SERVICE", "INSTANCES"}, groupInstances(instances, func(i discovery.Instance) []string {
+			return []string{i.Environment, i.Service}
+		}))
+	case "versions":
+		return printRows(*asJSON, []string{"ENVIRONMENT", "SERVICE", "VERSION", "INSTANCES"}, groupInstances(instances, func(i discovery.Instance) []string {
+			return []string{i.Environment, i.Service, i.Version}
+		}))
+	case "instances":
+		return printInstances(*asJSON, instances)
+	default:
+		fs.Usage()
+		return errUsage
+	}
+}
+
+func discover(c cli, args []string) error {
+	fs := newFlagSet("discover", "-service name [flags]")
+	var options discovery.DiscoverOptions
+	fs.StringVar(&options.Value, "service", "", "service name")
+	fs.StringVar(&options.Environment, "env", "", "environment (default: kumuluzee.env.name or dev)")
+	fs.StringVar(&options.Version, "version", "", "version range, e.g. ^1.2.0 (default: any version)")
+	fs.StringVar(&options.AccessType, "access-type", "", "access type, e.g. direct, gateway, container (default: gateway)")
+	fs.StringVar(&options.VersionPolicy, "version-policy", "", "version policy, e.g. latest, all-in-range (default: latest)")
+	fs.BoolVar(&options.IncludePrerelease, "include-prerelease", false, "match prerelease versions")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := requireFlags(fs, "service"); err != nil {
+		return err
+	}
+
+	serviceURL, err := c.discovery().DiscoverService(options)
+	if err != nil {
+		return err
+	}
+	fmt.Println(serviceURL)
+	return nil
+}
+
+func register(c cli, args []string) error {
+	fs := newFlagSet("register", "-env env -service name -version version -url url [flags]")
+	var instance discovery.StaticInstance
+	fs.StringVar(&instance.Environment, "env", "", "environment")
+	fs.StringVar(&instance.Service, "service", "", "service name")
+	fs.StringVar(&instance.Version, "version", "", "service version")
+	fs.StringVar(&instance.URL, "url", "", "direct URL of the instance, e.g. http://10.0.0.5:8080")
+	fs.StringVar(&instance.ID, "id", "", "instance id (default: random)")
+	fs.IntVar(&instance.Weight, "weight", 1, "instance weight")
+	fs.StringVar(&instance.Zone, "zone", "", "availability zone")
+	fs.StringVar(&instance.Region, "region", "", "region")
+	addresses := addressesFlag{}
+	fs.Var(addresses, "address", "additional address as access-type=url, e.g. container=http://172.17.0.2:8080 (can be repeated)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := requireFlags(fs, "env", "service", "version", "url"); err != nil {
+		return err
+	}
+	instance.Addresses = addresses
+
+	// with multiple backends, id is returned if registration succeeded in any of them
+	id, err := c.discovery().RegisterStaticInstance(instance)
+	if id != "" {
+		fmt.Println(id)
+	}
+	return err
+}
+
+func deregister(c cli, args []string) error {
+	fs := newFlagSet("deregister", "[-env env -service name] instance-id")
+	env := fs.String("env", "", "environment of the instance")
+	service := fs.String("service", "", "service name of the instance")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+	return c.discovery().DeregisterInstance(*env, *service, fs.Arg(0))
+}
+
+func gateway(c cli, args []string) error {
+	usage := "get|set|clear -env env [-service name -version version] [url]"
+	if len(args) == 0 {
+		newFlagSet("gateway", usage).Usage()
+		return errUsage
+	}
+	fs := newFlagSet("gateway "+args[0], usage)
+	env := fs.String("env", "", "environment")
+	service := fs.String("service", "", "service name")
+	version := fs.String("version", "", "service version")
+	asJSON := fs.Bool("json", false, "print JSON (get only)")
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+
+	disc := c.discovery()
+	switch args[0] {
+	case "get":
+		gatewayURLs, err := disc.ListGatewayURLs(*env)
+		if err != nil {
+			return err
+		}
+		var rows [][]string
+		for _, gw := range gatewayURLs {
+			if (*service == "" || gw.Service == *service) && (*version == "" || gw.Version == *version) {
+				rows = append(rows, []string{gw.Environment, gw.Service, gw.Version, gw.URL})
+			}
+		}
+		return printRows(*asJSON, []string{"ENVIRONMENT", "SERVICE", "VERSION", "URL"}, rows)
+	case "set":
+		if err := requireFlags(fs, "env", "service", "version"); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return errUsage
+		}
+		return disc.SetGatewayURL(*env, *service, *version, fs.Arg(0))
+	case "clear":
+		if err := requireFlags(fs, "env", "service", "version"); err != nil {
+			return err
+		}
+		return disc.ClearGatewayURL(*env, *service, *version)
+	default:
+		fs.Usage()
+		return errUsage
+	}
+}
+
+// polls the registry and prints added, changed and removed instances until interrupted
+func watch(c cli, args []string) error {
+	fs := newFlagSet("watch", "[-env env] [-service name] [flags]")
+	env := fs.String("env", "", "environment (default: all environments)")
+	service := fs.String("service", "", "service name (default: all services)")
+	interval := fs.Duration("interval", 5*time.Second, "polling interval")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	disc := c.discovery()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	known := make(map[string]discovery.Instance)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		instances, err := disc.ListInstances(*env, *service)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s listing instances failed: %s\n", time.Now().Format(time.RFC3339), err.Error())
+		} else {
+			current := make(map[string]discovery.Instance)
+			for _, i := range instances {
+				current[i.ID] = i
+				if old, ok := known[i.ID]; !ok {
+					printChange("added", i)
+				} else if instanceRow(old) != instanceRow(i) {
+					printChange("changed", i)
+				}
+			}
+			for id, i := range known {
+				if _, ok := current[id]; !ok {
+					printChange("removed", i)
+				}
+			}
+			known = current
+		}
+
+		select {
+		case <-signals:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// copies instances and gateway URLs from one discovery source to another
+func mirror(c cli, args []string) error {
+	fs := newFlagSet("mirror", "-from consul|etcd -to consul|etcd [flags]")
+	from := fs.String("from", "", "source discovery source, consul or etcd")
+	to := fs.String("to", "", "target discovery source, consul or etcd")
+	fromConfig := fs.String("from-config", "", "configuration file of the source (default: -config)")
+	toConfig := fs.String("to-config", "", "configuration file of the target (default: -config)")
+	var options discovery.MirrorOptions
+	fs.StringVar(&options.Environment, "env", "", "environment (default: all environments)")
+	fs.DurationVar(&options.Interval, "interval", 10*time.Second, "synchronization interval")
+	fs.BoolVar(&options.DryRun, "dry-run", false, "print changes without applying them")
+	once := fs.Bool("once", false, "synchronize once and exit")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := requireFlags(fs, "from", "to"); err != nil {
+		return err
+	}
+	if *from == *to && *fromConfig == *toConfig {
+		return fmt.Errorf("source and target are the same")
+	}
+	if *fromConfig == "" {
+		*fromConfig = c.configPath
+	}
+	if *toConfig == "" {
+		*toConfig = c.configPath
+	}
+
+	m := discovery.NewMirror(c.discoveryOf(*from, *fromConfig), c.discoveryOf(*to, *toConfig), options)
+	report := func(changes []discovery.MirrorChange) {
+		for _, change := range changes {
+			fmt.Printf("%s %s\n", time.Now().Format(time.RFC3339), change)
+		}
+	}
+
+	if *once {
+		changes, err := m.Sync()
+		report(changes)
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	m.Run(ctx, report)
+	return nil
+}
+
+func printChange(change string, i discovery.Instance) {
+	fmt.Printf("%s %-7s %s\n", time.Now().Format(time.RFC3339), change, instanceRow(i))
+}
+
+// output helpers
+
+var instanceColumns = []string{"ENVIRONMENT", "SERVICE", "VERSION", "ID", "URL", "STATUS", "HEALTHY", "WEIGHT", "ZONE", "REGION"}
+
+func instanceFields(i discovery.Instance) []string {
+	return []string{i.Environment, i.Service, i.Version, i.ID, i.URL, string(i.Status),
+		strconv.FormatBool(i.Healthy), strconv.Itoa(i.Weight), i.Zone, i.Region}
+}
+
+func instanceRow(i discovery.Instance) string {
+	row := strings.Join(instanceFields(i), " ")
+	var names []string
+	for name := range i.Addresses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		row += " " + name + "=" + i.Addresses[name]
+	}
+	return row
+}
+
+func printInstances(asJSON bool, instances []discovery.Instance) error {
+	if asJSON {
+		return printJSON(instances)
+	}
+	var rows [][]string
+	for _, i := range instances {
+		rows = append(rows, instanceFields(i))
+	}
+	return printRows(false, instanceColumns, rows)
+}
+
+// groups instances by key, returned rows are key values followed by instance count
+func groupInstances(instances []discovery.Instance, key func(discovery.Instance) []string) [][]string {
+	counts := make(map[string]int)
+	keys := make(map[string][]string)
+	for _, i := range instances {
+		k := key(i)
+		joined := strings.Join(k, "\x00")
+		counts[joined]++
+		keys[joined] = k
+	}
+
+	var rows [][]string
+	for joined, k := range keys {
+		rows = append(rows, append(k, strconv.Itoa(counts[joined])))
+	}
+	sort.Slice(rows, func(a, b int) bool {
+		return strings.Join(rows[a], "\x00") < strings.Join(rows[b], "\x00")
+	})
+	return rows
+}
+
+// prints rows as a table, or as JSON objects keyed by lowercase column names
+func printRows(asJSON bool, columns []string, rows [][]string) error {
+	if asJSON {
+		objects := make([]map[string]string, 0, len(rows))
+		for _, row := range rows {
+			object := make(map[string]string)
+			for c, column := range columns {
+				object[strings.ToLower(column)] = row[c]
+			}
+			objects = append(objects, object)
+		}
+		return printJSON(objects)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(columns, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// collects repeated -address access-type=url flags
+type addressesFlag map[string]string
+
+func (f addressesFlag) String() string {
+	var pairs []string
+	for name, addr := range f {
+		pairs = append(pairs, name+"="+addr)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f addressesFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("address must be in format access-type=url")
+	}
+	f[parts[0]] = parts[1]
+	return nil
+}
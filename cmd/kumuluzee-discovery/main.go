@@ -0,0 +1,159 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+// Command kumuluzee-discovery inspects and operates the service registry used by package discovery.
+// It works against Consul and etcd, configured with the same config.yaml as services.
+//
+// Usage:
+//
+//	kumuluzee-discovery [-config path] [-extension consul|etcd] [-v] <command> [arguments]
+//
+// Run kumuluzee-discovery -h for a list of commands.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mc0239/kumuluzee-go-config/config"
+	"github.com/mc0239/kumuluzee-go-discovery/discovery"
+	"github.com/mc0239/logm"
+)
+
+const usage = `Usage: kumuluzee-discovery [flags] <command> [arguments]
+
+Commands:
+  list envs|services|versions|instances   list registry contents
+  discover                                resolve a service like DiscoverService
+  register                                register a static instance
+  deregister                              remove an instance from the registry
+  gateway get|set|clear                   manage gateway URLs
+  watch                                   print instance changes of a service
+  mirror                                  copy instances and gateway URLs to another backend
+
+Run kumuluzee-discovery <command> -h for arguments of a command.
+
+Flags:
+`
+
+// global flags, used to connect to the discovery source
+type cli struct {
+	configPath string
+	extension  string
+	logLevel   int
+}
+
+// connects to the discovery source given by global flags
+func (c cli) discovery() discovery.Util {
+	return c.discoveryOf(c.extension, c.configPath)
+}
+
+// connects to given discovery source, empty extension is detected from configuration
+func (c cli) discoveryOf(extension, configPath string) discovery.Util {
+	if extension == "" {
+		extension = detectExtension(configPath)
+	}
+	return discovery.New(discovery.Options{
+		Extension:  extension,
+		ConfigPath: configPath,
+		LogLevel:   c.logLevel,
+	})
+}
+
+type command func(c cli, args []string) error
+
+var commands = map[string]command{
+	"list":       list,
+	"discover":   discover,
+	"register":   register,
+	"deregister": deregister,
+	"gateway":    gateway,
+	"watch":      watch,
+	"mirror":     mirror,
+}
+
+// errUsage is returned by commands when arguments are invalid, usage has already been printed
+var errUsage = fmt.Errorf("invalid arguments")
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	fs := flag.NewFlagSet("kumuluzee-discovery", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to configuration file (default config/config.yaml)")
+	extension := fs.String("extension", "", "discovery source, consul or etcd (default: etcd if kumuluzee.discovery.etcd.hosts is configured, consul otherwise)")
+	verbose := fs.Bool("v", false, "verbose logging")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", fs.Arg(0))
+		fs.Usage()
+		return 2
+	}
+
+	c := cli{
+		configPath: *configPath,
+		extension:  *extension,
+		logLevel:   logm.LvlError,
+	}
+	if *verbose {
+		c.logLevel = logm.LvlVerbose
+	}
+
+	if err := cmd(c, fs.Args()[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		} else if err == errUsage {
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s\n", fs.Arg(0), err.Error())
+		return 1
+	}
+	return 0
+}
+
+// services configure the extension in code, the CLI guesses it from client configuration
+func detectExtension(configPath string) string {
+	conf := config.NewUtil(config.Options{
+		ConfigPath: configPath,
+		LogLevel:   logm.LvlMute,
+	})
+	if _, ok := conf.GetString("kumuluzee.discovery.etcd.hosts"); ok {
+		return "etcd"
+	}
+	return "consul"
+}
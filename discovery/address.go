@@ -0,0 +1,194 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Possible strategies for advertise address detection, used in configuration key
+// kumuluzee.discovery.address.strategy
+const (
+	addressStrategyOverride  = "override"
+	addressStrategyInterface = "interface"
+	addressStrategyCIDR      = "cidr"
+	addressStrategyPodIP     = "pod-ip"
+	addressStrategyHostname  = "hostname"
+	addressStrategyIPv4      = "ipv4"
+	addressStrategyIPv6      = "ipv6"
+)
+
+// strategies are tried in this order if kumuluzee.discovery.address.strategy is not set
+var defaultAddressStrategies = []string{
+	addressStrategyOverride,
+	addressStrategyInterface,
+	addressStrategyCIDR,
+	addressStrategyPodIP,
+	addressStrategyIPv4,
+	addressStrategyIPv6,
+}
+
+// configuration bundle for advertise address detection (kumuluzee.discovery.address.*)
+type addressConfiguration struct {
+	// explicitly set address, used as is
+	Override string
+	// name of preferred network interface, e.g. eth0
+	Interface string
+	// first address matching this CIDR is used, e.g. 10.0.0.0/8
+	CIDR string `config:"cidr"`
+	// comma-separated list of strategies, tried in given order
+	Strategy string
+}
+
+// detectAdvertiseAddress returns the address (IP or hostname) under which this instance is
+// reachable by other services. Strategies are tried in configured order and the first one
+// that yields an address wins.
+func detectAdvertiseAddress(conf addressConfiguration) (string, error) {
+	strategies := defaultAddressStrategies
+	if conf.Strategy != "" {
+		strategies = strings.Split(conf.Strategy, ",")
+	}
+
+	for _, strategy := range strategies {
+		var addr string
+		var err error
+
+		switch strings.TrimSpace(strategy) {
+		case addressStrategyOverride:
+			addr = conf.Override
+		case addressStrategyInterface:
+			if conf.Interface != "" {
+				addr, err = interfaceAddress(conf.Interface)
+			}
+		case addressStrategyCIDR:
+			if conf.CIDR != "" {
+				addr, err = cidrAddress(conf.CIDR)
+			}
+		case addressStrategyPodIP:
+			addr = os.Getenv("POD_IP")
+		case addressStrategyHostname:
+			addr = os.Getenv("HOSTNAME")
+			if addr == "" {
+				addr, err = os.Hostname()
+			}
+		case addressStrategyIPv4:
+			addr, err = firstNonLoopbackAddress(func(ip net.IP) bool { return ip.To4() != nil })
+		case addressStrategyIPv6:
+			addr, err = firstNonLoopbackAddress(func(ip net.IP) bool { return ip.To4() == nil })
+		default:
+			return "", fmt.Errorf("unknown address detection strategy: %s", strategy)
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("address detection strategy %s failed: %s", strategy, err.Error())
+		}
+		if addr != "" {
+			return addr, nil
+		}
+	}
+
+	return "", fmt.Errorf("no address detected, tried strategies: %s", strings.Join(strategies, ","))
+}
+
+// returns advertise URL, built from protocol, detected address and port
+func advertiseURL(protocol string, address string, port int) string {
+	return fmt.Sprintf("%s://%s", protocol, net.JoinHostPort(address, fmt.Sprint(port)))
+}
+
+// returns first address of the interface with given name
+func interfaceAddress(name string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, a := range addrs {
+		if ip := ipFromAddr(a); ip != nil {
+			return ip.String(), nil
+		}
+	}
+	return "", nil
+}
+
+// returns first interface address that is inside given network
+func cidrAddress(cidr string) (string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, a := range addrs {
+		if ip := ipFromAddr(a); ip != nil && network.Contains(ip) {
+			return ip.String(), nil
+		}
+	}
+	return "", nil
+}
+
+// returns first non-loopback, non-link-local interface address for which match returns true
+func firstNonLoopbackAddress(match func(ip net.IP) bool) (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, a := range addrs {
+		ip := ipFromAddr(a)
+		if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || !match(ip) {
+			continue
+		}
+		return ip.String(), nil
+	}
+	return "", nil
+}
+
+func ipFromAddr(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.IPNet:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// returns advertise address for the service being registered. Configured server address takes
+// precedence over detection, unless it is unspecified (e.g. 0.0.0.0) or an override is set.
+func resolveAdvertiseAddress(regconf *registerConfiguration) (string, error) {
+	if a := regconf.Server.HTTP.Address; a != "" && regconf.Discovery.Address.Override == "" {
+		if ip := net.ParseIP(a); ip == nil || !ip.IsUnspecified() {
+			return a, nil
+		}
+	}
+	return detectAdvertiseAddress(regconf.Discovery.Address)
+}
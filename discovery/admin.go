@@ -0,0 +1,174 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+)
+
+// state of a discovery source, as reported by Util.AdminHandler
+type sourceState struct {
+	Backend           string                 `json:"backend"`
+	Registrations     []Registration         `json:"registrations"`
+	Cache             []cacheEntry           `json:"cache"`
+	GatewayURLWatches []gatewayURLWatchState `json:"gatewayUrlWatches"`
+	LastKnownServices map[string]string      `json:"lastKnownServices"`
+}
+
+// Registration is a service instance registered by this process in one backend, see
+// Util.Registrations.
+type Registration struct {
+	// ID of the instance in the backend.
+	ID string `json:"id"`
+	// ServiceID is the id returned by Util.RegisterService. With multiple backends, it is the id in
+	// the first backend, otherwise it is equal to ID.
+	ServiceID string `json:"serviceId"`
+	// Backend is the name of the backend, e.g. "consul".
+	Backend     string `json:"backend"`
+	Environment string `json:"environment"`
+	Service     string `json:"service"`
+	Version     string `json:"version"`
+	// Registered is false while registration or TTL updates fail.
+	Registered bool           `json:"registered"`
+	Status     InstanceStatus `json:"status"`
+	Weight     int            `json:"weight"`
+}
+
+// Registrations returns instances registered by this Util, with their registration state in each
+// backend.
+func (d Util) Registrations() []Registration {
+	return d.discoverySource.adminState().Registrations
+}
+
+type gatewayURLWatchState struct {
+	Namespace  string `json:"namespace"`
+	GatewayURL string `json:"gatewayUrl"`
+}
+
+func gatewayURLWatchStates(watches []*gatewayURLWatch) []gatewayURLWatchState {
+	states := []gatewayURLWatchState{}
+	for _, w := range watches {
+		states = append(states, gatewayURLWatchState{
+			Namespace:  w.gatewayID,
+			GatewayURL: w.gatewayURL,
+		})
+	}
+	return states
+}
+
+// AdminHandler returns an http.Handler that reports what this process knows about the registry,
+// and allows taking its instances out of rotation. Handler serves:
+//
+//	GET  .../             registrations, cached instances, gateway URL watches, last known service,
+//	                      circuits and dependencies
+//	POST .../drain        marks instances as draining
+//	POST .../deregister   deregisters instances
+//
+// POST endpoints apply to all instances registered by this process, or to a single instance with
+// query parameter id, which is rejected if the instance is not registered by this process. Paths
+// are matched by their last element, so the handler can be mounted at any path, e.g.:
+//
+//	http.Handle("/discovery/", disc.AdminHandler())
+//
+// Handler should only be exposed on an internal (admin) port.
+func (d Util) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path.Base(r.URL.Path) {
+		case "drain":
+			d.adminAction(w, r, func(id string) error {
+				return d.SetInstanceStatus(id, InstanceDraining)
+			})
+		case "deregister":
+			d.adminAction(w, r, func(id string) error {
+				return d.DeregisterInstance("", "", id)
+			})
+		default:
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			state := struct {
+				sourceState
+				Circuits     []circuitState    `json:"circuits"`
+				Dependencies []DependencyState `json:"dependencies"`
+			}{
+				sourceState:  d.discoverySource.adminState(),
+				Circuits:     d.outliers.states(),
+				Dependencies: d.Dependencies(),
+			}
+			writeJSON(w, http.StatusOK, state)
+		}
+	})
+}
+
+// applies action to instance given by id query parameter, or to all registered instances
+func (d Util) adminAction(w http.ResponseWriter, r *http.Request, action func(id string) error) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type result struct {
+		ID    string `json:"id"`
+		Error string `json:"error,omitempty"`
+	}
+
+	ids := d.discoverySource.RegisteredServiceIDs()
+	if id := r.URL.Query().Get("id"); id != "" {
+		var registered bool
+		for _, registeredID := range ids {
+			if registeredID == id {
+				registered = true
+				break
+			}
+		}
+		if !registered {
+			// only instances of this process may be taken out of rotation
+			writeJSON(w, http.StatusNotFound, []result{{ID: id, Error: "instance is not registered by this process"}})
+			return
+		}
+		ids = []string{id}
+	}
+
+	results := []result{}
+	status := http.StatusOK
+	for _, id := range ids {
+		res := result{ID: id}
+		if err := action(id); err != nil {
+			res.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+		results = append(results, res)
+	}
+	d.Logger.Info("Admin action performed", F("action", path.Base(r.URL.Path)), F("instances", len(results)))
+	writeJSON(w, status, results)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
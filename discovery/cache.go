@@ -0,0 +1,320 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mc0239/kumuluzee-go-config/config"
+)
+
+// instances found by the last successful discovery of each service. If a snapshot is set, entries
+// are persisted to disk, and entries loaded from disk are used when discovery fails.
+type discoveryCache struct {
+	mutex   sync.Mutex
+	entries map[string]cacheEntry // by environment and service name
+
+	backend  string
+	snapshot *cacheSnapshot
+}
+
+type cacheEntry struct {
+	Environment string     `json:"environment"`
+	Service     string     `json:"service"`
+	Instances   []Instance `json:"instances"`
+	// GatewayURLs are gateway URLs of the service, keyed by version.
+	GatewayURLs map[string]string `json:"gatewayUrls,omitempty"`
+	Updated     time.Time         `json:"updated"`
+}
+
+// returns a cache of given backend, seeded with entries from snapshot, which can be nil
+func newDiscoveryCache(backend string, snapshot *cacheSnapshot) *discoveryCache {
+	return &discoveryCache{
+		entries:  snapshot.entriesOf(backend),
+		backend:  backend,
+		snapshot: snapshot,
+	}
+}
+
+func (c *discoveryCache) set(environment, service string, instances []discoveredService, gatewayUrls []*gatewayURLWatch) {
+	entry := cacheEntry{
+		Environment: environment,
+		Service:     service,
+		Instances:   make([]Instance, 0, len(instances)),
+		Updated:     time.Now(),
+	}
+	for _, instance := range instances {
+		entry.Instances = append(entry.Instances, instance.instance(environment, service))
+
+		version := instance.version.String()
+		gatewayID := serviceVersionNamespace(environment, service, version)
+		for _, w := range gatewayUrls {
+			if w.gatewayID == gatewayID && w.gatewayURL != "" {
+				if entry.GatewayURLs == nil {
+					entry.GatewayURLs = make(map[string]string)
+				}
+				entry.GatewayURLs[version] = w.gatewayURL
+			}
+		}
+	}
+
+	c.mutex.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]cacheEntry)
+	}
+	c.entries[environment+"/"+service] = entry
+	c.mutex.Unlock()
+
+	c.snapshot.update(c.backend, entry)
+}
+
+// returns cached instances of service, if a snapshot is set and the entry is not older than its
+// maximal age. Used when discovery fails, e.g. when the registry is down at process start.
+func (c *discoveryCache) stale(environment, service string) ([]discoveredService, bool) {
+	if c.snapshot == nil {
+		return nil, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[environment+"/"+service]
+	if !ok || time.Since(entry.Updated) > c.snapshot.maxAge {
+		return nil, false
+	}
+
+	instances := make([]discoveredService, 0, len(entry.Instances))
+	for _, instance := range entry.Instances {
+		if discovered, ok := instance.discoveredService(); ok {
+			instances = append(instances, discovered)
+		}
+	}
+	return instances, true
+}
+
+// returns cached gateway URLs of entries, which are not older than maximal age of the snapshot
+func (c *discoveryCache) staleGatewayURLs() []*gatewayURLWatch {
+	if c.snapshot == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var watches []*gatewayURLWatch
+	for _, entry := range c.entries {
+		if time.Since(entry.Updated) > c.snapshot.maxAge {
+			continue
+		}
+		for version, gatewayURL := range entry.GatewayURLs {
+			watches = append(watches, &gatewayURLWatch{
+				gatewayID:  serviceVersionNamespace(entry.Environment, entry.Service, version),
+				gatewayURL: gatewayURL,
+			})
+		}
+	}
+	return watches
+}
+
+// returns all entries, ordered by environment and service name
+func (c *discoveryCache) all() []cacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entries := make([]cacheEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	sortCacheEntries(entries)
+	return entries
+}
+
+func sortCacheEntries(entries []cacheEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Environment != entries[j].Environment {
+			return entries[i].Environment < entries[j].Environment
+		}
+		return entries[i].Service < entries[j].Service
+	})
+}
+
+// returns path of the cache file and maximal age of cached instances, from configuration and Options
+func loadCacheFileOptions(conf config.Util, options Options) (string, time.Duration) {
+	// Load default values
+	file := ""
+	maxAge := 24 * time.Hour
+
+	// Load from configuration file, overriding defaults
+	if v, ok := conf.GetString("kumuluzee.discovery.cache.file"); ok {
+		file = v
+	}
+	if v, ok := conf.GetInt("kumuluzee.discovery.cache.max-age-ms"); ok {
+		maxAge = time.Duration(v) * time.Millisecond
+	}
+
+	// Load from Options, override file configuration
+	if options.CacheFile != "" {
+		file = options.CacheFile
+	}
+	if options.CacheMaxAge != 0 {
+		maxAge = options.CacheMaxAge
+	}
+
+	return file, maxAge
+}
+
+// unchanged entries are persisted again after this interval, so that maximal age of loaded entries
+// is measured from the last successful discovery
+const snapshotRefreshInterval = time.Minute
+
+// cache entries of all backends, persisted in a file
+type cacheSnapshot struct {
+	path   string
+	maxAge time.Duration
+	logger Logger
+
+	mutex   sync.Mutex
+	entries map[string]map[string]cacheEntry // by backend, then by environment and service name
+}
+
+// contents of the snapshot file
+type snapshotFile struct {
+	Backends map[string][]cacheEntry `json:"backends"`
+}
+
+// loads snapshot from given file. Entries older than maxAge are dropped. If the file can't be read,
+// snapshot starts empty.
+func loadCacheSnapshot(path string, maxAge time.Duration, logger Logger) *cacheSnapshot {
+	s := &cacheSnapshot{
+		path:    path,
+		maxAge:  maxAge,
+		logger:  withFields(logger, F("file", path)),
+		entries: make(map[string]map[string]cacheEntry),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s
+	} else if err != nil {
+		s.logger.Warn("Failed to read discovery cache snapshot", errField(err))
+		return s
+	}
+	var file snapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		s.logger.Warn("Failed to parse discovery cache snapshot", errField(err))
+		return s
+	}
+
+	var loaded int
+	for backend, entries := range file.Backends {
+		s.entries[backend] = make(map[string]cacheEntry)
+		for _, entry := range entries {
+			if time.Since(entry.Updated) > maxAge {
+				continue
+			}
+			s.entries[backend][entry.Environment+"/"+entry.Service] = entry
+			loaded++
+		}
+	}
+	s.logger.Info("Loaded discovery cache snapshot", F("entries", loaded))
+	return s
+}
+
+// returns a copy of entries of given backend
+func (s *cacheSnapshot) entriesOf(backend string) map[string]cacheEntry {
+	entries := make(map[string]cacheEntry)
+	if s == nil {
+		return entries
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, entry := range s.entries[backend] {
+		entries[key] = entry
+	}
+	return entries
+}
+
+// stores the entry and writes the snapshot file, if the entry has changed
+func (s *cacheSnapshot) update(backend string, entry cacheEntry) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := entry.Environment + "/" + entry.Service
+	if s.entries[backend] == nil {
+		s.entries[backend] = make(map[string]cacheEntry)
+	}
+	previous, ok := s.entries[backend][key]
+	if ok && entry.Updated.Sub(previous.Updated) < snapshotRefreshInterval &&
+		reflect.DeepEqual(previous.Instances, entry.Instances) && reflect.DeepEqual(previous.GatewayURLs, entry.GatewayURLs) {
+		return
+	}
+	s.entries[backend][key] = entry
+
+	if err := s.write(); err != nil {
+		s.logger.Warn("Failed to write discovery cache snapshot", errField(err))
+	}
+}
+
+// writes all entries to a temporary file, which then replaces the snapshot file, so that readers
+// never see a partially written snapshot
+func (s *cacheSnapshot) write() error {
+	file := snapshotFile{Backends: make(map[string][]cacheEntry)}
+	for backend, entries := range s.entries {
+		list := make([]cacheEntry, 0, len(entries))
+		for _, entry := range entries {
+			list = append(list, entry)
+		}
+		sortCacheEntries(list)
+		file.Backends[backend] = list
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after successful rename
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
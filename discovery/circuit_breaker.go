@@ -0,0 +1,382 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mc0239/kumuluzee-go-config/config"
+)
+
+// CircuitBreakerOptions configures per-instance circuit breakers, driven by results reported with
+// Util.ReportResult. Instances with an open circuit are ejected, i.e. skipped by service discovery.
+type CircuitBreakerOptions struct {
+	// Disabled turns circuit breakers off, instances are never ejected.
+	// Can be overridden with configuration key kumuluzee.discovery.circuit-breaker.disabled
+	Disabled bool
+	// Number of consecutive failures after which an instance is ejected.
+	// Default value is 5.
+	// Can be overridden with configuration key kumuluzee.discovery.circuit-breaker.consecutive-failures
+	ConsecutiveFailures int
+	// Calls slower than this threshold count as failures. Zero value disables the threshold.
+	// Can be overridden with configuration key kumuluzee.discovery.circuit-breaker.slow-call-threshold-ms
+	SlowCallThreshold time.Duration
+	// Duration of the first ejection. Each subsequent ejection of the same instance (without a
+	// successful call in between) lasts one EjectionDuration longer, up to MaxEjectionDuration.
+	// Default value is 30 seconds.
+	// Can be overridden with configuration key kumuluzee.discovery.circuit-breaker.ejection-duration-ms
+	EjectionDuration time.Duration
+	// Default value is 300 seconds.
+	// Can be overridden with configuration key kumuluzee.discovery.circuit-breaker.max-ejection-duration-ms
+	MaxEjectionDuration time.Duration
+	// If more than this percentage of service's instances is ejected, ejections are ignored for the
+	// service, so that a widespread failure does not leave the service without instances.
+	// Default value is 50.
+	// Can be overridden with configuration key kumuluzee.discovery.circuit-breaker.max-ejection-percent
+	MaxEjectionPercent int
+}
+
+// Possible circuit states of an instance
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// state of a circuit of a single instance
+type circuit struct {
+	consecutiveFailures int
+	ejections           int
+	ejectedUntil        time.Time
+}
+
+func (c *circuit) state(now time.Time) string {
+	if c.ejections == 0 {
+		return circuitClosed
+	}
+	if now.Before(c.ejectedUntil) {
+		return circuitOpen
+	}
+	// ejection has expired, next result decides whether the circuit closes
+	return circuitHalfOpen
+}
+
+// tracks results of calls to instances and ejects outliers
+type outlierDetector struct {
+	options CircuitBreakerOptions
+
+	mutex    sync.Mutex
+	circuits map[string]*circuit          // by instance id
+	urls     map[string]map[string]string // instance id by scheme://host of its URLs, by service namespace
+}
+
+func loadCircuitBreakerOptions(conf config.Util, options CircuitBreakerOptions) CircuitBreakerOptions {
+	// Load default values
+	cbo := CircuitBreakerOptions{
+		ConsecutiveFailures: 5,
+		EjectionDuration:    30 * time.Second,
+		MaxEjectionDuration: 300 * time.Second,
+		MaxEjectionPercent:  50,
+	}
+
+	// Load from configuration file, overriding defaults
+	if v, ok := conf.GetBool("kumuluzee.discovery.circuit-breaker.disabled"); ok {
+		cbo.Disabled = v
+	}
+	if v, ok := conf.GetInt("kumuluzee.discovery.circuit-breaker.consecutive-failures"); ok {
+		cbo.ConsecutiveFailures = v
+	}
+	if v, ok := conf.GetInt("kumuluzee.discovery.circuit-breaker.slow-call-threshold-ms"); ok {
+		cbo.SlowCallThreshold = time.Duration(v) * time.Millisecond
+	}
+	if v, ok := conf.GetInt("kumuluzee.discovery.circuit-breaker.ejection-duration-ms"); ok {
+		cbo.EjectionDuration = time.Duration(v) * time.Millisecond
+	}
+	if v, ok := conf.GetInt("kumuluzee.discovery.circuit-breaker.max-ejection-duration-ms"); ok {
+		cbo.MaxEjectionDuration = time.Duration(v) * time.Millisecond
+	}
+	if v, ok := conf.GetInt("kumuluzee.discovery.circuit-breaker.max-ejection-percent"); ok {
+		cbo.MaxEjectionPercent = v
+	}
+
+	// Load from Options, override file configuration
+	if options.Disabled {
+		cbo.Disabled = true
+	}
+	if options.ConsecutiveFailures != 0 {
+		cbo.ConsecutiveFailures = options.ConsecutiveFailures
+	}
+	if options.SlowCallThreshold != 0 {
+		cbo.SlowCallThreshold = options.SlowCallThreshold
+	}
+	if options.EjectionDuration != 0 {
+		cbo.EjectionDuration = options.EjectionDuration
+	}
+	if options.MaxEjectionDuration != 0 {
+		cbo.MaxEjectionDuration = options.MaxEjectionDuration
+	}
+	if options.MaxEjectionPercent != 0 {
+		cbo.MaxEjectionPercent = options.MaxEjectionPercent
+	}
+
+	return cbo
+}
+
+func newOutlierDetector(options CircuitBreakerOptions) *outlierDetector {
+	return &outlierDetector{
+		options:  options,
+		circuits: make(map[string]*circuit),
+		urls:     make(map[string]map[string]string),
+	}
+}
+
+// records a result of a call to the instance with given id. Returns true if the instance got ejected.
+func (o *outlierDetector) report(instanceID string, success bool, latency time.Duration) bool {
+	if o.options.Disabled {
+		return false
+	}
+	if o.options.SlowCallThreshold > 0 && latency > o.options.SlowCallThreshold {
+		success = false
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	c, ok := o.circuits[instanceID]
+	if !ok {
+		if success {
+			return false
+		}
+		c = &circuit{}
+		o.circuits[instanceID] = c
+	}
+
+	now := time.Now()
+	if success {
+		if c.state(now) != circuitOpen {
+			// half-open circuit closes after a successful call
+			delete(o.circuits, instanceID)
+		}
+		return false
+	}
+
+	c.consecutiveFailures++
+	state := c.state(now)
+	if state == circuitOpen {
+		return false
+	}
+	if state == circuitHalfOpen || c.consecutiveFailures >= o.options.ConsecutiveFailures {
+		c.ejections++
+		duration := time.Duration(c.ejections) * o.options.EjectionDuration
+		if duration > o.options.MaxEjectionDuration {
+			duration = o.options.MaxEjectionDuration
+		}
+		c.ejectedUntil = now.Add(duration)
+		c.consecutiveFailures = 0
+		return true
+	}
+	return false
+}
+
+// remembers URLs of discovered instances of a service, so that results of calls can be attributed
+// to instances. URLs and circuits of instances, that are no longer discovered, are forgotten.
+func (o *outlierDetector) track(namespace string, instances []discoveredService) {
+	if o == nil {
+		return
+	}
+
+	urls := make(map[string]string)
+	shared := make(map[string]bool)
+	ids := make(map[string]bool)
+	for _, instance := range instances {
+		ids[instance.id] = true
+		// gateway URLs are not remembered, and neither are other URLs shared between instances
+		// (e.g. of a load balancer), results of such calls can not be attributed
+		for _, u := range append([]string{instance.directURL}, addressValues(instance.addresses)...) {
+			key := urlKey(u)
+			if key == "" {
+				continue
+			}
+			if id, ok := urls[key]; ok && id != instance.id {
+				shared[key] = true
+			}
+			urls[key] = instance.id
+		}
+	}
+	for key := range shared {
+		delete(urls, key)
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, id := range o.urls[namespace] {
+		if !ids[id] {
+			delete(o.circuits, id)
+		}
+	}
+	o.urls[namespace] = urls
+}
+
+// returns instances that are not ejected. If more than MaxEjectionPercent of instances are ejected,
+// all of instances are returned.
+func (o *outlierDetector) filter(instances []discoveredService) []discoveredService {
+	if o == nil || o.options.Disabled {
+		return instances
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	now := time.Now()
+	var healthy []discoveredService
+	for _, instance := range instances {
+		if c, ok := o.circuits[instance.id]; !ok || c.state(now) != circuitOpen {
+			healthy = append(healthy, instance)
+		}
+	}
+
+	ejected := len(instances) - len(healthy)
+	if ejected*100 > len(instances)*o.options.MaxEjectionPercent {
+		return instances
+	}
+	return healthy
+}
+
+// returns instance id of instance with given URL, or an empty string if it is not known
+func (o *outlierDetector) instanceByURL(u *url.URL) string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, urls := range o.urls {
+		if id, ok := urls[u.Scheme+"://"+u.Host]; ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// circuit of an instance, as reported by Util.AdminHandler
+type circuitState struct {
+	InstanceID          string     `json:"instanceId"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	Ejections           int        `json:"ejections"`
+	EjectedUntil        *time.Time `json:"ejectedUntil,omitempty"`
+}
+
+// returns circuits that are not closed, ordered by instance id
+func (o *outlierDetector) states() []circuitState {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	now := time.Now()
+	states := []circuitState{}
+	for id, c := range o.circuits {
+		state := circuitState{
+			InstanceID:          id,
+			State:               c.state(now),
+			ConsecutiveFailures: c.consecutiveFailures,
+			Ejections:           c.ejections,
+		}
+		if c.ejections > 0 {
+			ejectedUntil := c.ejectedUntil
+			state.EjectedUntil = &ejectedUntil
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].InstanceID < states[j].InstanceID
+	})
+	return states
+}
+
+// returns URLs of named addresses
+func addressValues(addresses map[string]string) []string {
+	var values []string
+	for _, address := range addresses {
+		values = append(values, address)
+	}
+	return values
+}
+
+// returns scheme://host of given URL
+func urlKey(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// ReportResult reports a result of a call to a service instance, given by the URL returned by
+// Util.DiscoverService or by a request URL built from it. Results drive per-instance circuit
+// breakers: after a number of consecutive failures, the instance is ejected and skipped by service
+// discovery for the ejection duration. See CircuitBreakerOptions. Results for gateway URLs and for
+// URLs of instances that are not discovered are ignored, since they can't be attributed to an
+// instance.
+// HTTP clients can use Util.Transport instead, which reports results automatically.
+func (d Util) ReportResult(serviceURL string, success bool, latency time.Duration) {
+	u, err := url.Parse(serviceURL)
+	if err != nil {
+		return
+	}
+	instanceID := d.outliers.instanceByURL(u)
+	if instanceID == "" {
+		return
+	}
+	if d.outliers.report(instanceID, success, latency) {
+		d.Logger.Warn("Instance ejected after failed calls", instanceField(instanceID))
+	}
+}
+
+// Transport returns an http.RoundTripper that reports results of requests to discovered service
+// instances with Util.ReportResult. Requests fail if an error occurs or response status is 5xx.
+// If next is nil, http.DefaultTransport is used. Example:
+//
+//	client := &http.Client{Transport: disc.Transport(nil)}
+func (d Util) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &reportingTransport{
+		util: d,
+		next: next,
+	}
+}
+
+type reportingTransport struct {
+	util Util
+	next http.RoundTripper
+}
+
+func (t *reportingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	success := err == nil && resp.StatusCode < 500
+	t.util.ReportResult(req.URL.String(), success, time.Since(start))
+
+	return resp, err
+}
@@ -22,22 +22,29 @@
 package discovery
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"os"
+	"sort"
 	"strings"
-
-	"github.com/mc0239/logm"
+	"sync"
 
 	"github.com/blang/semver"
 	"github.com/mc0239/kumuluzee-go-config/config"
+	"github.com/mc0239/logm"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // configuration bundle for usage with kumuluzee config bundle
 type registerConfiguration struct {
 	Name   string
 	Server struct {
-		BaseURL string `config:"base-url"`
-		HTTP    struct {
+		BaseURL      string `config:"base-url"`
+		ContainerURL string `config:"container-url"`
+		InternalURL  string `config:"internal-url"`
+		ExternalURL  string `config:"external-url"`
+		HTTP         struct {
 			Port    int
 			Address string
 		} `config:"http"`
@@ -47,8 +54,12 @@ type registerConfiguration struct {
 	}
 	Version   string
 	Discovery struct {
-		TTL          int64 `config:"ttl"`
-		PingInterval int64 `config:"ping-interval"`
+		TTL          int64                `config:"ttl"`
+		PingInterval int64                `config:"ping-interval"`
+		Weight       int                  `config:"weight"`
+		Zone         string               `config:"zone"`
+		Region       string               `config:"region"`
+		Address      addressConfiguration `config:"address"`
 	}
 }
 
@@ -56,7 +67,87 @@ type discoveredService struct {
 	version   semver.Version
 	id        string
 	directURL string
-	// TODO: containerURL ?
+	// additional named URLs, keyed by access type
+	addresses map[string]string
+	status    InstanceStatus
+	weight    int
+	zone      string
+	region    string
+	// backend the instance is mirrored from, empty for registered instances
+	mirroredFrom string
+	// Consul datacenter the instance is discovered in
+	datacenter string
+	// URL resolved for current discovery request
+	url string
+}
+
+// discovery configuration, loaded when discovery source is created
+type discoverConfiguration struct {
+	zone                   string
+	region                 string
+	zoneSpilloverThreshold float64
+	environment            string
+	fallbackEnvironments   []string
+	datacenterFailover     string
+	generatePreparedQuery  bool
+}
+
+// state of a service instance registered by this process, shared between registration loop
+// and Util methods
+type instanceState struct {
+	mutex        sync.Mutex
+	registered   bool
+	status       InstanceStatus
+	weight       int
+	deregistered bool
+}
+
+func (s *instanceState) isRegistered() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.registered
+}
+
+func (s *instanceState) setRegistered(registered bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.registered = registered
+}
+
+func (s *instanceState) getStatus() InstanceStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.status
+}
+
+func (s *instanceState) setStatus(status InstanceStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status = status
+}
+
+func (s *instanceState) getWeight() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.weight
+}
+
+func (s *instanceState) setWeight(weight int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.weight = weight
+}
+
+func (s *instanceState) isDeregistered() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.deregistered
+}
+
+func (s *instanceState) markDeregistered() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.deregistered = true
 }
 
 type gatewayURLWatch struct {
@@ -64,7 +155,202 @@ type gatewayURLWatch struct {
 	gatewayURL string
 }
 
-//
+// gateway URL watches of discovered service versions, shared between discovering goroutines and
+// config subscriptions
+type gatewayURLWatchList struct {
+	mutex   sync.Mutex
+	watches []*gatewayURLWatch
+}
+
+// calls onChange with the current value of key in given namespace and later with each of its
+// changes. Backends read keys with their own (possibly authenticated) clients.
+type keyWatcher func(namespace, key string, onChange func(value string))
+
+// returns a keyWatcher which reads keys through the configuration extension
+func configKeyWatcher(configOptions config.Options) keyWatcher {
+	return func(namespace, key string, onChange func(value string)) {
+		util := config.NewUtil(config.Options{
+			Extension:          configOptions.Extension,
+			ExtensionNamespace: namespace,
+			ConfigPath:         configOptions.ConfigPath,
+			LogLevel:           logm.LvlMute,
+		})
+		value, _ := util.GetString(key)
+		onChange(value)
+		util.Subscribe(key, func(key string, value string) {
+			onChange(value)
+		})
+	}
+}
+
+// creates a watch for gateway URL of given service version namespace, if not already made
+func (ws *gatewayURLWatchList) watch(watchKey keyWatcher, namespace string, logger Logger, metrics *Metrics) {
+	ws.mutex.Lock()
+	for _, w := range ws.watches {
+		if w.gatewayID == namespace {
+			// watch already set :)
+			ws.mutex.Unlock()
+			return
+		}
+	}
+	// make a watch for this one!
+	logger.Info("Creating a gatewayUrl watch", F("namespace", namespace))
+	w := &gatewayURLWatch{gatewayID: namespace}
+	ws.watches = append(ws.watches, w)
+	ws.mutex.Unlock()
+
+	initial := true
+	watchKey(namespace, gatewayURLKey, func(value string) {
+		if !initial {
+			logger.Info("Updated gatewayUrl value", F("namespace", namespace), F("gateway_url", value))
+		}
+		ws.mutex.Lock()
+		w.gatewayURL = value
+		ws.mutex.Unlock()
+		if !initial {
+			metrics.gatewayURLUpdated(namespace)
+		}
+		initial = false
+	})
+}
+
+// returns copies of watches, which are not changed by later gateway URL updates
+func (ws *gatewayURLWatchList) snapshot() []*gatewayURLWatch {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	watches := make([]*gatewayURLWatch, 0, len(ws.watches))
+	for _, w := range ws.watches {
+		watches = append(watches, &gatewayURLWatch{
+			gatewayID:  w.gatewayID,
+			gatewayURL: w.gatewayURL,
+		})
+	}
+	return watches
+}
+
+// service URLs returned by the last successful discovery of each environment, service and version
+// range, used when discovery fails
+type lastKnownServices struct {
+	mutex    sync.Mutex
+	services map[string]string
+}
+
+// key of a discovered service, given by filled discover options
+func lastKnownKey(options DiscoverOptions) string {
+	return serviceVersionNamespace(options.Environment, options.Value, options.Version)
+}
+
+func (l *lastKnownServices) get(options DiscoverOptions) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.services[lastKnownKey(options)]
+}
+
+func (l *lastKnownServices) set(options DiscoverOptions, service string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.services == nil {
+		l.services = make(map[string]string)
+	}
+	l.services[lastKnownKey(options)] = service
+}
+
+// returns a copy of last known services by their keys
+func (l *lastKnownServices) all() map[string]string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	services := make(map[string]string, len(l.services))
+	for key, service := range l.services {
+		services[key] = service
+	}
+	return services
+}
+
+type staleFlagKey struct{}
+
+// returns a context which records whether service discovery returned the last known service
+// instead of a discovered one
+func withStaleFlag(ctx context.Context) (context.Context, *bool) {
+	stale := new(bool)
+	return context.WithValue(ctx, staleFlagKey{}, stale), stale
+}
+
+// records a fallback to the last known service in the span and stale flag of ctx
+func markStale(ctx context.Context) {
+	trace.SpanFromContext(ctx).SetAttributes(attrFallback.Bool(true))
+	if stale, ok := ctx.Value(staleFlagKey{}).(*bool); ok {
+		*stale = true
+	}
+}
+
+// key under which gateway URL is stored, relative to service version namespace
+const gatewayURLKey = "gatewayUrl"
+
+// key under which the backend a gateway URL is mirrored from is stored, relative to service version
+// namespace
+const gatewayURLMirroredFromKey = "gatewayUrlMirroredFrom"
+
+// keys under which instance weight, locality and mirroring source are stored (etcd keys or Consul
+// service meta)
+const (
+	weightKey       = "weight"
+	zoneKey         = "zone"
+	regionKey       = "region"
+	mirroredFromKey = "mirroredFrom"
+)
+
+// Consul service meta keys, under which environment and service name are stored
+const (
+	environmentKey = "environment"
+	serviceKey     = "service"
+)
+
+// environment variables that locality is detected from, if not set in configuration
+var (
+	zoneEnvVars   = []string{"ZONE", "AVAILABILITY_ZONE"}
+	regionEnvVars = []string{"REGION", "AWS_REGION", "AWS_DEFAULT_REGION"}
+)
+
+// returns KV namespace of given service version, e.g. /environments/dev/services/my-service/1.0.0
+func serviceVersionNamespace(environment, service, version string) string {
+	return fmt.Sprintf("/environments/%s/services/%s/%s", environment, service, version)
+}
+
+// parses key /environments/{env}/services/{name}/{version}/gatewayUrl (leading slash is optional)
+func parseGatewayURLKey(key, name string) (gw GatewayURL, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(key, "/"), "/")
+	if len(parts) != 6 || parts[0] != "environments" || parts[2] != "services" || parts[5] != name {
+		return gw, false
+	}
+	gw.Environment = parts[1]
+	gw.Service = parts[3]
+	gw.Version = parts[4]
+	return gw, true
+}
+
+// returns gateway URLs from values of keys in service version namespaces, marked with the backend
+// they are mirrored from
+func gatewayURLsOf(values map[string]string) []GatewayURL {
+	mirroredFrom := make(map[string]string)
+	var keys []string
+	for key, value := range values {
+		if gw, ok := parseGatewayURLKey(key, gatewayURLMirroredFromKey); ok {
+			mirroredFrom[serviceVersionNamespace(gw.Environment, gw.Service, gw.Version)] = value
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var gatewayURLs []GatewayURL
+	for _, key := range keys {
+		if gw, ok := parseGatewayURLKey(key, gatewayURLKey); ok && values[key] != "" {
+			gw.URL = values[key]
+			gw.MirroredFrom = mirroredFrom[serviceVersionNamespace(gw.Environment, gw.Service, gw.Version)]
+			gatewayURLs = append(gatewayURLs, gw)
+		}
+	}
+	return gatewayURLs
+}
 
 func getRetryDelays(conf config.Util) (startRD, maxRD int64) {
 	if sdl, ok := conf.GetInt("kumuluzee.config.start-retry-delay-ms"); ok {
@@ -82,17 +368,79 @@ func getRetryDelays(conf config.Util) (startRD, maxRD int64) {
 	return
 }
 
-func fillDefaultDiscoverOptions(options *DiscoverOptions) {
+func loadDiscoverConfiguration(conf config.Util) (discconf discoverConfiguration) {
+	discconf.zone, _ = conf.GetString("kumuluzee.discovery.zone")
+	discconf.region, _ = conf.GetString("kumuluzee.discovery.region")
+	discconf.zone, discconf.region = detectLocality(discconf.zone, discconf.region)
+	discconf.zoneSpilloverThreshold, _ = conf.GetFloat("kumuluzee.discovery.zone-spillover-threshold")
+	discconf.environment, _ = conf.GetString("kumuluzee.env.name")
+	if environments, ok := conf.GetString("kumuluzee.discovery.fallback-environments"); ok {
+		for _, environment := range strings.Split(environments, ",") {
+			if environment = strings.TrimSpace(environment); environment != "" {
+				discconf.fallbackEnvironments = append(discconf.fallbackEnvironments, environment)
+			}
+		}
+	}
+	discconf.datacenterFailover, _ = conf.GetString("kumuluzee.discovery.consul.datacenter-failover")
+	discconf.generatePreparedQuery, _ = conf.GetBool("kumuluzee.discovery.consul.generate-prepared-queries")
+	return
+}
+
+// returns given zone and region, or values from environment variables if they are empty
+func detectLocality(zone, region string) (string, string) {
+	for _, env := range zoneEnvVars {
+		if zone != "" {
+			break
+		}
+		zone = os.Getenv(env)
+	}
+	for _, env := range regionEnvVars {
+		if region != "" {
+			break
+		}
+		region = os.Getenv(env)
+	}
+	return zone, region
+}
+
+func fillDefaultDiscoverOptions(options *DiscoverOptions, discconf discoverConfiguration) {
 	// Load default values
+	if options.Environment == "" {
+		options.Environment = discconf.environment
+	}
 	if options.Environment == "" {
 		options.Environment = "dev"
 	}
+	if options.FallbackEnvironments == nil {
+		options.FallbackEnvironments = discconf.fallbackEnvironments
+	}
 	if options.Version == "" {
 		options.Version = ">=0.0.0" // discover ANY version
 	}
 	if options.AccessType == "" {
 		options.AccessType = AccessTypeGateway
 	}
+	if options.VersionPolicy == "" {
+		options.VersionPolicy = VersionPolicyLatest
+	}
+	if options.Zone == "" {
+		options.Zone = discconf.zone
+	}
+	if options.Region == "" {
+		options.Region = discconf.region
+	}
+	if options.ZoneSpilloverThreshold == 0 {
+		options.ZoneSpilloverThreshold = discconf.zoneSpilloverThreshold
+	}
+	if options.DatacenterFailover == "" {
+		options.DatacenterFailover = discconf.datacenterFailover
+	}
+	if options.DatacenterFailover == "" {
+		options.DatacenterFailover = DatacenterFailoverListed
+	}
+	if !options.GeneratePreparedQuery {
+		options.GeneratePreparedQuery = discconf.generatePreparedQuery
+	}
 }
 
 func loadServiceRegisterConfiguration(confOptions config.Options, regOptions RegisterOptions) (regconf registerConfiguration) {
@@ -103,6 +451,7 @@ func loadServiceRegisterConfiguration(confOptions config.Options, regOptions Reg
 	regconf.Version = "1.0.0"
 	regconf.Discovery.TTL = 30
 	regconf.Discovery.PingInterval = 20
+	regconf.Discovery.Weight = 1
 
 	// Load from configuration file, overriding defaults
 	config.NewBundle("kumuluzee", &regconf, config.Options{
@@ -126,65 +475,216 @@ func loadServiceRegisterConfiguration(confOptions config.Options, regOptions Reg
 	if regOptions.PingInterval != 0 {
 		regconf.Discovery.PingInterval = regOptions.PingInterval
 	}
+	if regOptions.Weight != 0 {
+		regconf.Discovery.Weight = regOptions.Weight
+	}
+	if regOptions.Zone != "" {
+		regconf.Discovery.Zone = regOptions.Zone
+	}
+	if regOptions.Region != "" {
+		regconf.Discovery.Region = regOptions.Region
+	}
+	regconf.Discovery.Zone, regconf.Discovery.Region = detectLocality(regconf.Discovery.Zone, regconf.Discovery.Region)
 
 	return
 }
 
-func parseVersion(version string) (semver.Range, error) {
-	version = strings.Replace(version, "*", "x", -1)
+// returns additional named addresses of the service being registered. Addresses from
+// RegisterOptions override ones from configuration.
+func loadServiceAddresses(regconf registerConfiguration, regOptions RegisterOptions) map[string]string {
+	addresses := make(map[string]string)
+	if regconf.Server.ContainerURL != "" {
+		addresses[AccessTypeContainer] = regconf.Server.ContainerURL
+	}
+	if regconf.Server.InternalURL != "" {
+		addresses[AccessTypeInternal] = regconf.Server.InternalURL
+	}
+	if regconf.Server.ExternalURL != "" {
+		addresses[AccessTypeExternal] = regconf.Server.ExternalURL
+	}
+	for name, url := range regOptions.Addresses {
+		if name == AccessTypeDirect || name == AccessTypeGateway {
+			continue
+		}
+		addresses[name] = url
+	}
+	return addresses
+}
+
+// named addresses are stored as <name>Url, e.g. containerUrl (same as gatewayUrl)
+func addressKey(name string) string {
+	return name + "Url"
+}
+
+// returns address name from key, or false if key is not an address key
+func addressName(key string) (string, bool) {
+	if !strings.HasSuffix(key, "Url") || key == gatewayURLKey {
+		return "", false
+	}
+	name := strings.TrimSuffix(key, "Url")
+	return name, name != ""
+}
+
+// returns ordered list of access types from DiscoverOptions
+func accessTypePreference(options DiscoverOptions) []string {
+	if len(options.AccessTypes) > 0 {
+		return options.AccessTypes
+	}
+	if options.AccessType == AccessTypeGateway {
+		return []string{AccessTypeGateway, AccessTypeDirect}
+	}
+	return []string{options.AccessType}
+}
 
-	if strings.HasPrefix(version, "^") {
-		ver, err := semver.ParseTolerant(version[1:])
-		if err == nil {
-			var verNext = ver
-			verNext.Major++
-			return semver.ParseRange(">=" + ver.String() + " <" + verNext.String())
+// returns URL of instance for the first access type in preference that the instance has an URL for
+func instanceURL(instance discoveredService, accessTypes []string, gatewayURL string) string {
+	for _, accessType := range accessTypes {
+		var url string
+		switch accessType {
+		case AccessTypeGateway:
+			url = gatewayURL
+		case AccessTypeDirect:
+			url = instance.directURL
+		default:
+			url = instance.addresses[accessType]
 		}
-		return nil, err
-	} else if strings.HasPrefix(version, "~") {
-		ver, err := semver.ParseTolerant(version[1:])
-		if err == nil {
-			var verNext = ver
-			verNext.Minor++
-			return semver.ParseRange(">=" + ver.String() + " <" + verNext.String())
+		if url != "" {
+			return url
 		}
-		return nil, err
-	} else {
-		return semver.ParseRange(version)
 	}
+	return ""
 }
 
-func extractServicesWithVersion(services []discoveredService, wantVersion semver.Range) []discoveredService {
-	var matchingServices []discoveredService
-	// first, get all services that are within range, and store the latest version found
-	// then, return services that match only the latest version
-
+// returns instances of versions selected by options.VersionPolicy. All of given instances are
+// expected to be usable, therefore versions without usable instances are skipped, e.g. when the
+// latest version has no healthy instances, the next highest version is selected.
+func selectVersions(instances []discoveredService, options DiscoverOptions) ([]discoveredService, error) {
+	// latest version of each major version
+	latestOfMajor := make(map[uint64]semver.Version)
 	var latestVersion semver.Version
-	for _, s := range services {
-		// if service version is in range of wantVersion
-		if wantVersion(s.version) {
-			// store latest version
-			if s.version.GTE(latestVersion) {
-				latestVersion = s.version
+	for _, s := range instances {
+		if s.version.GTE(latestVersion) {
+			latestVersion = s.version
+		}
+		if v, ok := latestOfMajor[s.version.Major]; !ok || s.version.GT(v) {
+			latestOfMajor[s.version.Major] = s.version
+		}
+	}
+
+	var selected []discoveredService
+	switch options.VersionPolicy {
+	case VersionPolicyLatest:
+		for _, s := range instances {
+			if s.version.EQ(latestVersion) {
+				selected = append(selected, s)
+			}
+		}
+	case VersionPolicyAllInRange:
+		selected = instances
+	case VersionPolicyLatestMajorSpread:
+		for _, s := range instances {
+			if s.version.EQ(latestOfMajor[s.version.Major]) {
+				selected = append(selected, s)
 			}
 		}
+	case VersionPolicyPinned:
+		pinnedVersion, err := semver.ParseTolerant(options.PinnedVersion)
+		if err != nil {
+			return nil, fmt.Errorf("PinnedVersion parse error: %s", err.Error())
+		}
+		for _, s := range instances {
+			if s.version.EQ(pinnedVersion) {
+				selected = append(selected, s)
+			}
+		}
+		if len(selected) == 0 {
+			// fallback to latest version
+			options.VersionPolicy = VersionPolicyLatest
+			return selectVersions(instances, options)
+		}
+	default:
+		return nil, fmt.Errorf("unknown version policy: %s", options.VersionPolicy)
+	}
+
+	return selected, nil
+}
+
+// returns gateway URL of given service version, or an empty string if it is not set
+func gatewayURLOf(gatewayUrls []*gatewayURLWatch, options DiscoverOptions, version semver.Version) string {
+	watcherNamespace := serviceVersionNamespace(options.Environment, options.Value, version.String())
+	for _, w := range gatewayUrls {
+		if w.gatewayID == watcherNamespace {
+			return w.gatewayURL
+		}
 	}
+	return ""
+}
 
-	for _, s := range services {
-		// if service is of latestVersion
-		if s.version.EQ(latestVersion) {
-			matchingServices = append(matchingServices, s)
+// keeps only usable instances: enabled (disabled and draining instances are out of rotation),
+// matching version and with an URL for any of preferred access types. URLs of returned instances are
+// resolved. Also returns the number of enabled instances with matching version.
+func usableInstances(discoveredInstances []discoveredService, gatewayUrls []*gatewayURLWatch, options DiscoverOptions, wantVersion semver.Range) ([]discoveredService, int) {
+	accessTypes := accessTypePreference(options)
+	var matchingVersion int
+	var candidates []discoveredService
+	for _, instance := range discoveredInstances {
+		if !instance.status.isEnabled() || !wantVersion(instance.version) {
+			continue
+		}
+		matchingVersion++
+
+		instance.url = instanceURL(instance, accessTypes, gatewayURLOf(gatewayUrls, options, instance.version))
+		if instance.url != "" {
+			candidates = append(candidates, instance)
 		}
 	}
+	return candidates, matchingVersion
+}
 
-	return matchingServices
+// returns true if any of instances is usable, disregarding circuit breakers and traffic splits
+func hasUsableInstance(instances []discoveredService, gatewayUrls []*gatewayURLWatch, options DiscoverOptions) bool {
+	wantVersion, err := parseVersionRange(options.Version, options.IncludePrerelease)
+	if err != nil {
+		// there is no point in failing over, version range is invalid anywhere
+		return true
+	}
+	candidates, _ := usableInstances(instances, gatewayUrls, options, wantVersion)
+	return len(candidates) > 0
+}
+
+// discovers instances of service in the environment of discover options and, if there are no
+// usable instances, in fallback environments, in order. Returns instances and discover options with
+// the environment they are found in. If no environment has usable instances, result of the primary
+// environment is returned.
+func discoverInEnvironments(ctx context.Context, src instanceSource, options DiscoverOptions, logger Logger) ([]discoveredService, DiscoverOptions, error) {
+	instances, err := src.discoverInstances(ctx, options)
+	if len(options.FallbackEnvironments) == 0 || err == nil && hasUsableInstance(instances, src.gatewayURLWatches(), options) {
+		return instances, options, err
+	}
+
+	for _, environment := range options.FallbackEnvironments {
+		fallback := options
+		fallback.Environment = environment
+		fallbackInstances, fallbackErr := src.discoverInstances(ctx, fallback)
+		if fallbackErr != nil {
+			logger.Debug("Service discovery in fallback environment failed", serviceField(options.Value), F("environment", environment), errField(fallbackErr))
+			continue
+		}
+		if hasUsableInstance(fallbackInstances, src.gatewayURLWatches(), fallback) {
+			logger.Info("No usable instances in environment, using fallback environment", serviceField(options.Value),
+				F("environment", options.Environment), F("fallback_environment", environment))
+			trace.SpanFromContext(ctx).SetAttributes(attrEnvironment.String(environment))
+			return fallbackInstances, fallback, nil
+		}
+	}
+	return instances, options, err
 }
 
 // returns a randomly picked instace from discovered services.
 // Note that function can return both a valid, non-empty service string and an error, which means
 // that no proper service could be found and the lastKnownService string is being returned
-func pickRandomServiceInstance(discoveredInstances []discoveredService, gatewayUrls []*gatewayURLWatch, options DiscoverOptions, lastKnownService string) (service string, err error) {
-	wantVersion, err := parseVersion(options.Version)
+func pickRandomServiceInstance(discoveredInstances []discoveredService, gatewayUrls []*gatewayURLWatch, trafficSplit []TrafficSplitRule, outliers *outlierDetector, options DiscoverOptions, lastKnownService string) (service string, err error) {
+	wantVersion, err := parseVersionRange(options.Version, options.IncludePrerelease)
 	if err != nil {
 		if lastKnownService != "" {
 			return lastKnownService, fmt.Errorf("wantVersion parse error: %s", err.Error())
@@ -192,33 +692,128 @@ func pickRandomServiceInstance(discoveredInstances []discoveredService, gatewayU
 		return "", fmt.Errorf("wantVersion parse error: %s", err.Error())
 	}
 
-	// pick a random service instance from registered instances that match version
-	instances := extractServicesWithVersion(discoveredInstances, wantVersion)
-	if len(instances) == 0 {
+	outliers.track(serviceNamespace(options.Environment, options.Value), discoveredInstances)
+
+	candidates, matchingVersion := usableInstances(discoveredInstances, gatewayUrls, options, wantVersion)
+	if matchingVersion == 0 {
 		if lastKnownService != "" {
 			return lastKnownService, fmt.Errorf("No service found (no matching version)")
 		}
 		return "", fmt.Errorf("No service found (no matching version)")
 	}
+	if len(candidates) == 0 {
+		if lastKnownService != "" {
+			return lastKnownService, fmt.Errorf("No service found (no service with URL)")
+		}
+		return "", fmt.Errorf("No service found (no service with URL)")
+	}
 
-	randomInstance := instances[rand.Intn(len(instances))]
-
-	var instanceGatewayURL string
-	watcherNamespace := fmt.Sprintf("/environments/%s/services/%s/%s", options.Environment, options.Value, randomInstance.version.String())
-	for _, w := range gatewayUrls {
-		if w.gatewayID == watcherNamespace {
-			instanceGatewayURL = w.gatewayURL
+	// instances with open circuits are skipped
+	candidates = outliers.filter(candidates)
+	if len(candidates) == 0 {
+		if lastKnownService != "" {
+			return lastKnownService, fmt.Errorf("No service found (all instances ejected)")
 		}
+		return "", fmt.Errorf("No service found (all instances ejected)")
 	}
 
-	if options.AccessType == AccessTypeGateway && instanceGatewayURL != "" {
-		return instanceGatewayURL, nil
-	} else if randomInstance.directURL != "" {
-		return randomInstance.directURL, nil
-	} else {
+	// traffic split rules narrow down the version range
+	candidates = applyTrafficSplit(candidates, trafficSplit, options.StickyKey)
+
+	candidates, err = selectVersions(candidates, options)
+	if err != nil {
 		if lastKnownService != "" {
-			return lastKnownService, fmt.Errorf("No service found (no service with URL)")
+			return lastKnownService, err
 		}
-		return "", fmt.Errorf("No service found (no service with URL)")
+		return "", err
+	}
+
+	// prefer instances in the same zone (or region)
+	local := localInstances(candidates, options)
+	var weights []int
+	for i, instance := range candidates {
+		if !local[i] {
+			weights = append(weights, -1)
+		} else if instance.weight < 0 {
+			weights = append(weights, 0)
+		} else {
+			weights = append(weights, instance.weight)
+		}
+	}
+
+	return candidates[pickWeightedIndex(weights)].url, nil
+}
+
+// marks instances that should receive traffic with regard to locality. Same-zone instances are
+// preferred, as long as their share of total capacity (weight) is at least
+// options.ZoneSpilloverThreshold. Otherwise, same-region instances are preferred, and if there are
+// none, all of instances are used.
+func localInstances(instances []discoveredService, options DiscoverOptions) []bool {
+	inZone := make([]bool, len(instances))
+	inRegion := make([]bool, len(instances))
+	var zoneCount, regionCount, zoneWeight, totalWeight int
+	for i, instance := range instances {
+		w := instance.weight
+		if w < 0 {
+			w = 0
+		}
+		totalWeight += w
+		if options.Zone != "" && instance.zone == options.Zone {
+			inZone[i] = true
+			zoneCount++
+			zoneWeight += w
+		}
+		if options.Region != "" && instance.region == options.Region {
+			inRegion[i] = true
+			regionCount++
+		}
+	}
+
+	if zoneCount > 0 {
+		share := float64(zoneCount) / float64(len(instances))
+		if totalWeight > 0 {
+			share = float64(zoneWeight) / float64(totalWeight)
+		}
+		if share >= options.ZoneSpilloverThreshold {
+			return inZone
+		}
+	}
+	if regionCount > 0 {
+		return inRegion
+	}
+
+	all := make([]bool, len(instances))
+	for i := range all {
+		all[i] = true
+	}
+	return all
+}
+
+// returns a random index, with probability proportional to weight. Indices with weight 0 are
+// only picked if all of weights are 0, and indices with negative weight are never picked.
+func pickWeightedIndex(weights []int) int {
+	total := 0
+	var zeroWeighted []int
+	for i, w := range weights {
+		if w > 0 {
+			total += w
+		} else if w == 0 {
+			zeroWeighted = append(zeroWeighted, i)
+		}
+	}
+	if total == 0 {
+		return zeroWeighted[rand.Intn(len(zeroWeighted))]
+	}
+
+	r := rand.Intn(total)
+	for i, w := range weights {
+		if w <= 0 {
+			continue
+		}
+		if r < w {
+			return i
+		}
+		r -= w
 	}
+	return len(weights) - 1
 }
@@ -0,0 +1,128 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ConnectOptions configures Consul Connect (service mesh) registration of a service. Only supported
+// by Consul.
+type ConnectOptions struct {
+	// Native registers the service as Connect-native, i.e. the service terminates mesh TLS itself,
+	// and no sidecar proxy is registered.
+	Native bool
+	// SidecarPort is the port of the sidecar proxy. If 0, Consul assigns a port from its sidecar
+	// port range.
+	SidecarPort int
+	// Upstreams of the sidecar proxy, i.e. services the registered service calls through the mesh.
+	Upstreams []ConnectUpstream
+}
+
+// ConnectUpstream is an upstream of a sidecar proxy. Sidecar proxy listens on a local port and
+// forwards connections to instances of the upstream service through the mesh.
+type ConnectUpstream struct {
+	// Name of the upstream service.
+	Service string
+	// Environment of the upstream service.
+	// Default value is the environment of the registered service.
+	Environment string
+	// Datacenter of the upstream service. Default is the local datacenter.
+	Datacenter string
+	// Local address and port the sidecar proxy listens on for the upstream.
+	// Default address is 127.0.0.1.
+	LocalBindAddress string
+	LocalBindPort    int
+}
+
+// Possible Consul Connect discovery modes for DiscoverOptions.ConnectMode
+const (
+	// Connect-capable instances, i.e. sidecar proxies and Connect-native services, are discovered
+	// instead of services themselves. Callers have to speak mesh TLS, i.e. be Connect-native.
+	ConnectModeMesh = "mesh"
+	// Local address of a sidecar proxy upstream of a service registered with this discovery.Util is
+	// returned. Version and access type are ignored, version is resolved by the mesh.
+	ConnectModeUpstream = "upstream"
+)
+
+// returns Connect definition of a registered service, or nil if it is not a mesh service
+func connectRegistration(inst *consulServiceInstance) *api.AgentServiceConnect {
+	if inst.connect == nil {
+		return nil
+	}
+	if inst.connect.Native {
+		return &api.AgentServiceConnect{Native: true}
+	}
+
+	proxy := &api.AgentServiceConnectProxyConfig{}
+	for _, upstream := range inst.connect.Upstreams {
+		environment := upstream.Environment
+		if environment == "" {
+			environment = inst.options.Env.Name
+		}
+		proxy.Upstreams = append(proxy.Upstreams, api.Upstream{
+			DestinationType:  api.UpstreamDestTypeService,
+			DestinationName:  environment + "-" + upstream.Service,
+			Datacenter:       upstream.Datacenter,
+			LocalBindAddress: upstream.LocalBindAddress,
+			LocalBindPort:    upstream.LocalBindPort,
+		})
+	}
+
+	// tags and meta (version, weight, zone, ...) are inherited by the sidecar
+	return &api.AgentServiceConnect{
+		SidecarService: &api.AgentServiceRegistration{
+			Port:  inst.connect.SidecarPort,
+			Proxy: proxy,
+		},
+	}
+}
+
+// returns local URL of the sidecar proxy upstream for the service, given by filled discover options
+func (d *consulDiscoverySource) upstreamURL(options DiscoverOptions) (string, error) {
+	d.instancesMutex.Lock()
+	defer d.instancesMutex.Unlock()
+
+	for _, inst := range d.serviceInstances {
+		if inst.connect == nil {
+			continue
+		}
+		for _, upstream := range inst.connect.Upstreams {
+			environment := upstream.Environment
+			if environment == "" {
+				environment = inst.options.Env.Name
+			}
+			if environment != options.Environment || upstream.Service != options.Value {
+				continue
+			}
+
+			address := upstream.LocalBindAddress
+			if address == "" {
+				address = "127.0.0.1"
+			}
+			return fmt.Sprintf("http://%s:%d", address, upstream.LocalBindPort), nil
+		}
+	}
+	return "", fmt.Errorf("No service found (no sidecar upstream for %s in %s)", options.Value, options.Environment)
+}
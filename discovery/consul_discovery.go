@@ -22,9 +22,13 @@
 package discovery
 
 import (
+	"context"
 	"fmt"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/blang/semver"
@@ -32,6 +36,7 @@ import (
 	"github.com/mc0239/kumuluzee-go-config/config"
 	"github.com/mc0239/logm"
 	"github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // holds consul client instance and configuration
@@ -42,31 +47,51 @@ type consulDiscoverySource struct {
 	maxRetryDelay   int64
 	protocol        string
 
-	configOptions   config.Options         // passed when calling new...()
-	options         *registerConfiguration // loaded as config bundle
-	serviceInstance *consulServiceInstance
+	configOptions    config.Options        // passed when calling new...()
+	discoverOptions  discoverConfiguration // loaded when calling new...()
+	serviceInstances []*consulServiceInstance
+	instancesMutex   sync.Mutex
 
-	lastKnownService string // last known service from discovery
-	gatewayURLs      []*gatewayURLWatch
+	lastKnownServices lastKnownServices // last known service of each discovered service
+	cache             *discoveryCache   // instances found by last discovery of each service
+	gatewayURLs       gatewayURLWatchList
+	trafficSplits     trafficSplitWatches
+	outliers          *outlierDetector // shared with Util
 
-	logger *logm.Logm
+	datacenter      string // local datacenter, loaded on first failover to nearest datacenters
+	datacenterMutex sync.Mutex
+
+	preparedQueries      map[string]bool // names of generated prepared queries, known to exist
+	preparedQueriesMutex sync.Mutex
+
+	logger  Logger
+	metrics *Metrics
+	tracer  trace.Tracer
 }
 
 // holds service instance configuration and state
 type consulServiceInstance struct {
-	isRegistered bool
+	instanceState
 
+	options    *registerConfiguration // loaded as config bundle
 	id         string
 	name       string
 	versionTag string
+	addresses  map[string]string
+	connect    *ConnectOptions
 
 	singleton bool
 }
 
-func newConsulDiscoverySource(options config.Options, logger *logm.Logm) discoverySource {
+func newConsulDiscoverySource(options config.Options, logger Logger, outliers *outlierDetector, metrics *Metrics, tracer trace.Tracer, snapshot *cacheSnapshot) instanceSource {
 	var d consulDiscoverySource
-	logger.Verbose("Initializing Consul discovery source")
+	logger = withFields(logger, F(FieldBackend, "consul"))
+	logger.Debug("Initializing Consul discovery source")
 	d.logger = logger
+	d.outliers = outliers
+	d.metrics = metrics
+	d.tracer = tracer
+	d.cache = newDiscoveryCache("consul", snapshot)
 
 	d.configOptions = options
 	conf := config.NewUtil(config.Options{
@@ -74,10 +99,12 @@ func newConsulDiscoverySource(options config.Options, logger *logm.Logm) discove
 		LogLevel:   logm.LvlWarning, // bit less logs from config
 	})
 
+	d.discoverOptions = loadDiscoverConfiguration(conf)
+
 	startRD, maxRD := getRetryDelays(conf)
 	d.startRetryDelay = startRD
 	d.maxRetryDelay = maxRD
-	logger.Verbose("start-retry-delay-ms=%d, max-retry-delay-ms=%d", d.startRetryDelay, d.maxRetryDelay)
+	logger.Debug("Retry delays set", F("start_retry_delay_ms", d.startRetryDelay), F("max_retry_delay_ms", d.maxRetryDelay))
 
 	var consulAddress string
 	if addr, ok := conf.GetString("kumuluzee.discovery.consul.hosts"); ok {
@@ -86,10 +113,10 @@ func newConsulDiscoverySource(options config.Options, logger *logm.Logm) discove
 		consulAddress = "http://localhost:8500"
 	}
 	if client, err := createConsulClient(consulAddress); err == nil {
-		logger.Info("Consul client address set to %v", consulAddress)
+		logger.Info("Consul client address set", F("address", consulAddress))
 		d.client = client
 	} else {
-		logger.Error("Failed to create Consul client: %s", err.Error())
+		logger.Error("Failed to create Consul client", errField(err))
 	}
 
 	if p, ok := conf.GetString("kumuluzee.discovery.consul.protocol"); ok {
@@ -103,165 +130,516 @@ func newConsulDiscoverySource(options config.Options, logger *logm.Logm) discove
 
 func (d *consulDiscoverySource) RegisterService(options RegisterOptions) (serviceID string, err error) {
 	regconf := loadServiceRegisterConfiguration(d.configOptions, options)
-	d.options = &regconf
 
-	d.serviceInstance = &consulServiceInstance{
+	inst := &consulServiceInstance{
+		options:   &regconf,
+		addresses: loadServiceAddresses(regconf, options),
+		connect:   options.Connect,
 		singleton: options.Singleton,
 	}
+	inst.status = InstanceEnabled
+	inst.weight = regconf.Discovery.Weight
 
 	uuid4, err := uuid.NewV4()
 	if err != nil {
-		d.logger.Error(err.Error())
+		d.logger.Error("Generating instance id failed", errField(err))
 	}
 
-	d.serviceInstance.id = d.options.Name + "-" + uuid4.String()
-	d.serviceInstance.name = d.options.Env.Name + "-" + d.options.Name
-	d.serviceInstance.versionTag = "version=" + d.options.Version
+	inst.id = regconf.Name + "-" + uuid4.String()
+	inst.name = regconf.Env.Name + "-" + regconf.Name
+	inst.versionTag = "version=" + regconf.Version
+
+	d.instancesMutex.Lock()
+	d.serviceInstances = append(d.serviceInstances, inst)
+	d.instancesMutex.Unlock()
 
-	go d.run(d.startRetryDelay)
+	go d.run(inst, d.startRetryDelay)
 
-	return d.serviceInstance.id, nil
+	return inst.id, nil
 }
 
 func (d *consulDiscoverySource) DeregisterService() error {
-	d.logger.Info("Service deregistration, id=%s", d.serviceInstance.id)
-	return d.client.Agent().ServiceDeregister(d.serviceInstance.id)
+	d.instancesMutex.Lock()
+	instances := d.serviceInstances
+	d.serviceInstances = nil
+	d.instancesMutex.Unlock()
+
+	var lastErr error
+	for _, inst := range instances {
+		d.logger.Info("Service deregistration", serviceField(inst.options.Name), instanceField(inst.id))
+		inst.markDeregistered()
+		_, req := startBackendRequest(context.Background(), d.tracer, d.metrics, "consul", "deregister",
+			attrService.String(inst.options.Name), attrInstanceID.String(inst.id))
+		err := d.client.Agent().ServiceDeregister(inst.id)
+		req.end(err)
+		if err != nil {
+			d.logger.Error("Service deregistration failed", serviceField(inst.options.Name), instanceField(inst.id), errField(err))
+			lastErr = err
+		}
+		d.metrics.deregistered(inst.options.Name, inst.id)
+	}
+	return lastErr
 }
 
-func (d *consulDiscoverySource) DiscoverService(options DiscoverOptions) (string, error) {
-	fillDefaultDiscoverOptions(&options)
+func (d *consulDiscoverySource) DiscoverService(ctx context.Context, options DiscoverOptions) (string, error) {
+	fillDefaultDiscoverOptions(&options, d.discoverOptions)
+	requested := options // options are changed by fallback environments
 
-	queryServiceName := options.Environment + "-" + options.Value
-	serviceEntries, _, err := d.client.Health().Service(queryServiceName, "", true, nil)
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attrEnvironment.String(options.Environment), attrVersionRange.String(options.Version))
+
+	if options.ConnectMode == ConnectModeUpstream {
+		service, err := d.upstreamURL(options)
+		if err != nil {
+			d.logger.Error("Service discovery failed", serviceField(options.Value), errField(err))
+		}
+		return service, err
+	}
+
+	discoveredInstances, options, err := discoverInEnvironments(ctx, d, options, d.logger)
 	if err != nil {
-		if d.lastKnownService != "" {
-			d.logger.Warning("Service discovery failed, using last known service. Error: %s", err.Error())
-			return d.lastKnownService, nil
+		if lastKnown := d.lastKnownServices.get(requested); lastKnown != "" {
+			d.logger.Warn("Service discovery failed, using last known service", serviceField(options.Value), errField(err))
+			d.metrics.staleFallback(options.Value)
+			markStale(ctx)
+			return lastKnown, nil
 		}
-		d.logger.Error("Service discovery failed: %s", err.Error())
+		d.logger.Error("Service discovery failed", serviceField(options.Value), errField(err))
 		return "", err
 	}
 
+	if len(discoveredInstances) > 0 {
+		span.SetAttributes(attrDatacenter.String(discoveredInstances[0].datacenter))
+	}
+
+	trafficSplit := d.trafficSplitRules(options.Environment, options.Value)
+	service, err := pickRandomServiceInstance(discoveredInstances, d.gatewayURLWatches(), trafficSplit, d.outliers, options, d.lastKnownServices.get(requested))
+
+	if err != nil {
+		if service != "" {
+			d.logger.Warn("Service discovery failed, using last known service", serviceField(options.Value), errField(err))
+			d.metrics.staleFallback(options.Value)
+			markStale(ctx)
+			return service, nil
+		}
+
+		d.logger.Error("Service discovery failed", serviceField(options.Value), errField(err))
+		return "", err
+	}
+
+	span.SetAttributes(attrFallback.Bool(false))
+	d.lastKnownServices.set(requested, service)
+	return service, nil
+}
+
+// returns instances of all versions of service, given by filled discover options, and creates
+// gateway URL watches for their versions. If discovery fails, cached instances are returned, if a
+// cache snapshot is set.
+func (d *consulDiscoverySource) discoverInstances(ctx context.Context, options DiscoverOptions) ([]discoveredService, error) {
+	discoveredInstances, err := d.queryInstances(ctx, options)
+	if err != nil {
+		if stale, ok := d.cache.stale(options.Environment, options.Value); ok {
+			d.logger.Warn("Service discovery failed, using cached instances", serviceField(options.Value), errField(err))
+			d.metrics.staleFallback(options.Value)
+			trace.SpanFromContext(ctx).SetAttributes(attrStale.Bool(true))
+			return stale, nil
+		}
+		return nil, err
+	}
+
+	d.metrics.setDiscoveredInstances(options.Value, len(discoveredInstances))
+	d.cache.set(options.Environment, options.Value, discoveredInstances, d.gatewayURLs.snapshot())
+
+	return discoveredInstances, nil
+}
+
+// queries instances of all versions of service and creates gateway URL watches for their versions.
+// If there is no usable instance in the local datacenter, failover datacenters are tried.
+func (d *consulDiscoverySource) queryInstances(ctx context.Context, options DiscoverOptions) ([]discoveredService, error) {
+	if options.PreparedQuery != "" || options.GeneratePreparedQuery {
+		// failover is done by the prepared query
+		return d.executePreparedQuery(ctx, options)
+	}
+
+	discoveredInstances, err := d.discoverDatacenterInstances(ctx, options, "")
+	if err != nil || !hasUsableInstance(discoveredInstances, d.gatewayURLs.snapshot(), options) {
+		for _, datacenter := range d.failoverDatacenters(ctx, options) {
+			dcInstances, dcErr := d.discoverDatacenterInstances(ctx, options, datacenter)
+			if dcErr != nil {
+				d.logger.Warn("Service discovery in failover datacenter failed", serviceField(options.Value), F("datacenter", datacenter), errField(dcErr))
+				continue
+			}
+			if hasUsableInstance(dcInstances, d.gatewayURLs.snapshot(), options) {
+				d.logger.Info("No usable instances in local datacenter, failing over", serviceField(options.Value), F("datacenter", datacenter))
+				discoveredInstances, err = dcInstances, nil
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return discoveredInstances, nil
+}
+
+// returns instances of service in given datacenter, or in the local datacenter if it is empty
+func (d *consulDiscoverySource) discoverDatacenterInstances(ctx context.Context, options DiscoverOptions, datacenter string) ([]discoveredService, error) {
+	queryServiceName := options.Environment + "-" + options.Value
+	reqCtx, req := startBackendRequest(ctx, d.tracer, d.metrics, "consul", "discover")
+	queryOptions := &api.QueryOptions{Datacenter: datacenter}
+	var serviceEntries []*api.ServiceEntry
+	var err error
+	if options.ConnectMode == ConnectModeMesh {
+		serviceEntries, _, err = d.client.Health().Connect(queryServiceName, "", true, queryOptions.WithContext(reqCtx))
+	} else {
+		serviceEntries, _, err = d.client.Health().Service(queryServiceName, "", true, queryOptions.WithContext(reqCtx))
+	}
+	req.end(err)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.serviceEntryInstances(options, serviceEntries), nil
+}
+
+// extracts instances from service entries and creates gateway URL watches for their versions
+func (d *consulDiscoverySource) serviceEntryInstances(options DiscoverOptions, serviceEntries []*api.ServiceEntry) []discoveredService {
 	// ----- extract all services of all versions of given environment and name
 	var discoveredInstances []discoveredService
 	for _, serviceEntry := range serviceEntries {
-		discoveredInstance := discoveredService{}
-		discoveredInstance.id = serviceEntry.Service.ID
-
-		versionOk := false
-		protocol := "http"
-		for _, tag := range serviceEntry.Service.Tags {
-			if strings.HasPrefix(tag, "version") {
-				t := strings.Split(tag, "=")
-				version, err := semver.ParseTolerant(t[1])
-				if err != nil {
-					d.logger.Warning("semver parsing failed for: %s, error: %s", t[1], err.Error())
-					versionOk = false
-					break
-				}
-				discoveredInstance.version = version
-				versionOk = true
-			} else if tag == "https" {
-				protocol = "https"
-			}
-		}
-		if !versionOk {
+		discoveredInstance, ok := d.discoveredInstance(serviceEntry)
+		if !ok {
 			continue // ignore this service, can't parse version
 		}
 
-		var addr string
-		if a := serviceEntry.Service.Address; a != "" {
-			addr = a
-		} else {
-			// if address is not set, it's equal to node's address
-			addr = serviceEntry.Node.Address
+		discoveredInstances = append(discoveredInstances, discoveredInstance)
+
+		// ---- add a watch for gatewayUrl for discovering service (if not already made)
+		watcherNamespace := serviceVersionNamespace(options.Environment, options.Value, discoveredInstance.version.String())
+		d.gatewayURLs.watch(configKeyWatcher(d.configOptions), watcherNamespace, d.logger, d.metrics)
+		// ----
+	}
+	// -----
+
+	return discoveredInstances
+}
+
+// returns datacenters to try if there are no usable instances in the local datacenter, in order
+func (d *consulDiscoverySource) failoverDatacenters(ctx context.Context, options DiscoverOptions) []string {
+	if options.DatacenterFailover != DatacenterFailoverNearest {
+		return options.Datacenters
+	}
+
+	local, err := d.localDatacenter()
+	if err != nil {
+		d.logger.Warn("Failed to get local datacenter, using listed failover datacenters", errField(err))
+		return options.Datacenters
+	}
+
+	_, req := startBackendRequest(ctx, d.tracer, d.metrics, "consul", "coordinates")
+	coordinates, err := d.client.Coordinate().Datacenters()
+	req.end(err)
+	if err != nil {
+		d.logger.Warn("Failed to get datacenter coordinates, using listed failover datacenters", errField(err))
+		return options.Datacenters
+	}
+
+	datacenters := options.Datacenters
+	if len(datacenters) == 0 {
+		for _, dc := range coordinates {
+			datacenters = append(datacenters, dc.Datacenter)
 		}
+	}
+	return nearestDatacenters(local, datacenters, coordinates)
+}
 
-		discoveredInstance.directURL = fmt.Sprintf("%s://%s:%d",
-			protocol,
-			addr,
-			serviceEntry.Service.Port)
+// returns name of the datacenter of the Consul agent
+func (d *consulDiscoverySource) localDatacenter() (string, error) {
+	d.datacenterMutex.Lock()
+	defer d.datacenterMutex.Unlock()
 
-		discoveredInstances = append(discoveredInstances, discoveredInstance)
+	if d.datacenter != "" {
+		return d.datacenter, nil
+	}
+	self, err := d.client.Agent().Self()
+	if err != nil {
+		return "", err
+	}
+	if dc, ok := self["Config"]["Datacenter"].(string); ok && dc != "" {
+		d.datacenter = dc
+		return dc, nil
+	}
+	return "", fmt.Errorf("datacenter missing in agent configuration")
+}
 
-		// ---- add a watch for gatewayUrl for discovering service (if not already made)
-		watcherNamespace := fmt.Sprintf("/environments/%s/services/%s/%s", options.Environment, options.Value, discoveredInstance.version.String())
+func (d *consulDiscoverySource) gatewayURLWatches() []*gatewayURLWatch {
+	// cached gateway URLs are only used for versions without a watch
+	watches := d.gatewayURLs.snapshot()
+	return append(watches, d.cache.staleGatewayURLs()...)
+}
 
-		util := config.NewUtil(config.Options{
-			Extension:          d.configOptions.Extension,
-			ExtensionNamespace: watcherNamespace,
-			ConfigPath:         d.configOptions.ConfigPath,
-			LogLevel:           logm.LvlMute,
-		})
+func (d *consulDiscoverySource) trafficSplitRules(environment, service string) []TrafficSplitRule {
+	return d.trafficSplits.rules(configKeyWatcher(d.configOptions), environment, service, d.logger)
+}
 
-		var hasWatch bool
-		for _, w := range d.gatewayURLs {
-			if w.gatewayID == watcherNamespace {
-				// watch already set :)
-				hasWatch = true
-				break
-			}
+// weight is a part of service definition, therefore the instance is re-registered
+func (d *consulDiscoverySource) SetInstanceWeight(serviceID string, weight int) error {
+	inst := d.findInstance(serviceID)
+	if inst == nil {
+		return fmt.Errorf("instance with id %s is not registered by this process", serviceID)
+	}
+	inst.setWeight(weight)
+	if !inst.isRegistered() {
+		// new weight is used when registration succeeds
+		return nil
+	}
+
+	d.logger.Info("Setting instance weight", serviceField(inst.options.Name), instanceField(serviceID), F("weight", weight))
+	agentRegistration := d.agentServiceRegistration(inst)
+	agentRegistration.Check.Status = api.HealthPassing
+	return d.client.Agent().ServiceRegister(agentRegistration)
+}
+
+func (d *consulDiscoverySource) RegisteredServiceIDs() []string {
+	d.instancesMutex.Lock()
+	defer d.instancesMutex.Unlock()
+	var ids []string
+	for _, inst := range d.serviceInstances {
+		ids = append(ids, inst.id)
+	}
+	return ids
+}
+
+// disabled and draining instances are put into maintenance mode, which fails their health check
+func (d *consulDiscoverySource) SetInstanceStatus(serviceID string, status InstanceStatus) error {
+	if inst := d.findInstance(serviceID); inst != nil {
+		inst.setStatus(status)
+	}
+	return d.applyInstanceStatus(serviceID, status)
+}
+
+// Consul KV keys have no leading slash
+func (d *consulDiscoverySource) SetKey(key, value string) error {
+	_, err := d.client.KV().Put(&api.KVPair{
+		Key:   strings.TrimPrefix(key, "/"),
+		Value: []byte(value),
+	}, nil)
+	return err
+}
+
+func (d *consulDiscoverySource) DeleteKey(key string) error {
+	_, err := d.client.KV().Delete(strings.TrimPrefix(key, "/"), nil)
+	return err
+}
+
+func (d *consulDiscoverySource) ListGatewayURLs(environment string) ([]GatewayURL, error) {
+	prefix := "environments/"
+	if environment != "" {
+		prefix += environment + "/"
+	}
+
+	pairs, _, err := d.client.KV().List(prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for _, pair := range pairs {
+		values[pair.Key] = string(pair.Value)
+	}
+	return gatewayURLsOf(values), nil
+}
+
+// Consul service names are <environment>-<service>. Environment and service are stored in service
+// meta, since they can't be told apart in the name if they contain dashes. For instances without
+// them, environment is assumed to end at the first dash if neither is given.
+func (d *consulDiscoverySource) ListInstances(environment, service string) ([]Instance, error) {
+	var names []string
+	if environment != "" && service != "" {
+		names = []string{environment + "-" + service}
+	} else {
+		services, _, err := d.client.Catalog().Services(nil)
+		if err != nil {
+			return nil, err
 		}
-		if !hasWatch {
-			// make a watch for this one!
-			d.logger.Info("Creating a gatewayUrl watch for %s", watcherNamespace)
-
-			g, _ := util.GetString("gatewayUrl")
-			d.gatewayURLs = append(d.gatewayURLs, &gatewayURLWatch{
-				gatewayID:  watcherNamespace,
-				gatewayURL: g,
-			})
-			util.Subscribe("gatewayUrl", func(key string, value string) {
-				for _, w := range d.gatewayURLs {
-					if w.gatewayID == watcherNamespace {
-						d.logger.Info("Updated gatewayUrl value for %s (new value: %s)", watcherNamespace, value)
-						w.gatewayURL = value
-						break
-					}
+		for name := range services {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	var instances []Instance
+	for _, name := range names {
+		env, svc, ok := splitConsulServiceName(name, environment, service)
+		if !ok {
+			continue
+		}
+		serviceEntries, _, err := d.client.Health().Service(name, "", false, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, serviceEntry := range serviceEntries {
+			discoveredInstance, ok := d.discoveredInstance(serviceEntry)
+			if !ok {
+				continue
+			}
+			instance := discoveredInstance.instance(env, svc)
+			if metaEnv, metaSvc := serviceEntry.Service.Meta[environmentKey], serviceEntry.Service.Meta[serviceKey]; metaEnv != "" && metaSvc != "" {
+				if (environment != "" && metaEnv != environment) || (service != "" && metaSvc != service) {
+					continue
 				}
-				return
-			})
+				instance.Environment, instance.Service = metaEnv, metaSvc
+			}
+			instance.Healthy = serviceEntry.Checks.AggregatedStatus() == api.HealthPassing
+			instances = append(instances, instance)
 		}
-		// ----
 	}
-	// -----
-	service, err := pickRandomServiceInstance(discoveredInstances, d.gatewayURLs, options, d.lastKnownService)
+	return instances, nil
+}
 
+// static instances have no health check, Consul treats them as passing. Instances with TTL have a
+// TTL check instead
+func (d *consulDiscoverySource) RegisterStaticInstance(instance StaticInstance) (string, error) {
+	u, err := url.Parse(instance.URL)
 	if err != nil {
-		if service != "" {
-			d.logger.Warning("Service discovery failed, using last known service. Error: %s", err.Error())
-			return d.lastKnownService, nil
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
 		}
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return "", err
+	}
 
-		d.logger.Error("Service discovery failed: %s", err.Error())
+	if instance.ID == "" {
+		uuid4, err := uuid.NewV4()
+		if err != nil {
+			return "", err
+		}
+		instance.ID = instance.Service + "-" + uuid4.String()
+	}
+
+	// Consul weights have to be positive, exact weight is stored in meta
+	passingWeight := instance.Weight
+	if passingWeight < 1 {
+		passingWeight = 1
+	}
+
+	agentRegistration := api.AgentServiceRegistration{
+		ID:      instance.ID,
+		Name:    instance.Environment + "-" + instance.Service,
+		Address: u.Hostname(),
+		Port:    portNumber,
+		Tags:    []string{u.Scheme, "version=" + instance.Version},
+		Meta:    make(map[string]string),
+		Weights: &api.AgentWeights{
+			Passing: passingWeight,
+			Warning: 1,
+		},
+	}
+	if instance.TTL > 0 {
+		agentRegistration.Check = &api.AgentServiceCheck{
+			CheckID:                        "check-" + instance.ID,
+			TTL:                            instance.TTL.String(),
+			Status:                         api.HealthPassing,
+			DeregisterCriticalServiceAfter: instance.TTL.String(),
+		}
+	}
+	agentRegistration.Meta[environmentKey] = instance.Environment
+	agentRegistration.Meta[serviceKey] = instance.Service
+	for name, addr := range instance.Addresses {
+		agentRegistration.Meta[addressKey(name)] = addr
+	}
+	agentRegistration.Meta[weightKey] = strconv.Itoa(instance.Weight)
+	if instance.Zone != "" {
+		agentRegistration.Meta[zoneKey] = instance.Zone
+	}
+	if instance.Region != "" {
+		agentRegistration.Meta[regionKey] = instance.Region
+	}
+	if instance.MirroredFrom != "" {
+		agentRegistration.Meta[mirroredFromKey] = instance.MirroredFrom
+	}
+
+	if err := d.client.Agent().ServiceRegister(&agentRegistration); err != nil {
 		return "", err
 	}
+	return instance.ID, nil
+}
 
-	d.lastKnownService = service
-	return service, nil
+func (d *consulDiscoverySource) refreshStaticInstance(instance StaticInstance) error {
+	return d.client.Agent().UpdateTTL("check-"+instance.ID, "", api.HealthPassing)
+}
+
+// instances can only be deregistered through the agent they are registered with. Instances of this
+// process stop updating TTL
+func (d *consulDiscoverySource) DeregisterInstance(environment, service, instanceID string) error {
+	if inst := d.removeInstance(instanceID); inst != nil {
+		inst.markDeregistered()
+		d.metrics.deregistered(inst.options.Name, inst.id)
+	}
+	return d.client.Agent().ServiceDeregister(instanceID)
+}
+
+func (d *consulDiscoverySource) adminState() sourceState {
+	d.instancesMutex.Lock()
+	registrations := []Registration{}
+	for _, inst := range d.serviceInstances {
+		registrations = append(registrations, Registration{
+			ID:          inst.id,
+			ServiceID:   inst.id,
+			Backend:     "consul",
+			Environment: inst.options.Env.Name,
+			Service:     inst.options.Name,
+			Version:     inst.options.Version,
+			Registered:  inst.isRegistered(),
+			Status:      inst.getStatus(),
+			Weight:      inst.getWeight(),
+		})
+	}
+	d.instancesMutex.Unlock()
+
+	return sourceState{
+		Backend:           "consul",
+		Registrations:     registrations,
+		Cache:             d.cache.all(),
+		GatewayURLWatches: gatewayURLWatchStates(d.gatewayURLs.snapshot()),
+		LastKnownServices: d.lastKnownServices.all(),
+	}
 }
 
 // functions that aren't discoverySource methods
 
 // if service is not registered, performs registration. Otherwise perform ttl update
-func (d *consulDiscoverySource) run(retryDelay int64) {
+func (d *consulDiscoverySource) run(inst *consulServiceInstance, retryDelay int64) {
+	if inst.isDeregistered() {
+		return
+	}
 
 	var ok, firstTTL bool
-	if !d.serviceInstance.isRegistered {
-		ok = d.register(retryDelay)
+	if !inst.isRegistered() {
+		ok = d.register(inst, retryDelay)
 		if ok {
 			firstTTL = true
-			d.serviceInstance.isRegistered = true
+			inst.setRegistered(true)
 		}
 	} else {
-		ok = d.ttlUpdate(retryDelay)
+		ok = d.ttlUpdate(inst, retryDelay)
 		if !ok {
-			d.serviceInstance.isRegistered = false
+			inst.setRegistered(false)
+			d.metrics.heartbeatFailed(inst.options.Name, inst.id)
 		}
 	}
+	d.metrics.setRegistered(inst.options.Name, inst.id, inst.isRegistered())
 
 	if !ok {
 		// Something went wrong with either registration or TTL update :(
+		d.metrics.setRetryDelay(inst.options.Name, inst.id, retryDelay)
 
 		// sleep for current delay
 		time.Sleep(time.Duration(retryDelay) * time.Millisecond)
@@ -270,90 +648,251 @@ func (d *consulDiscoverySource) run(retryDelay int64) {
 		if newRetryDelay > d.maxRetryDelay {
 			newRetryDelay = d.maxRetryDelay
 		}
-		d.run(newRetryDelay)
+		d.run(inst, newRetryDelay)
 	} else {
 		// Everything is alright, either registration or TTL update was successful :)
+		d.metrics.setRetryDelay(inst.options.Name, inst.id, 0)
 
 		// Note: Perform a TTL update immediately after registration
 		// registering with Consul does not assume successful TTL update and has to be done manually
 		// immediately after registration)
 		if !firstTTL {
-			time.Sleep(time.Duration(d.options.Discovery.PingInterval) * time.Second)
+			time.Sleep(time.Duration(inst.options.Discovery.PingInterval) * time.Second)
 			firstTTL = false
 		}
-		d.run(d.startRetryDelay)
+		d.run(inst, d.startRetryDelay)
 	}
 
 }
 
-func (d *consulDiscoverySource) register(retryDelay int64) bool {
-	inst := d.serviceInstance
+func (d *consulDiscoverySource) register(inst *consulServiceInstance, retryDelay int64) bool {
+	if d.isServiceRegistered(inst) && inst.singleton {
+		d.logger.Error("Service of this kind is already registered, not registering with options.singleton set to true",
+			serviceField(inst.options.Name), instanceField(inst.id))
+		return false
+	}
+
+	agentRegistration := d.agentServiceRegistration(inst)
+
+	d.logger.Info("Registering service", serviceField(inst.options.Name), instanceField(inst.id),
+		F("address", agentRegistration.Address), F("port", agentRegistration.Port))
+
+	_, req := startBackendRequest(context.Background(), d.tracer, d.metrics, "consul", "register",
+		attrService.String(inst.options.Name), attrInstanceID.String(inst.id))
+	err := d.client.Agent().ServiceRegister(agentRegistration)
+	req.end(err)
 
-	if d.isServiceRegistered() && inst.singleton {
-		d.logger.Error("Service of this kind is already registered, not registering with options.singleton set to true")
+	if err != nil {
+		d.logger.Error("Service registration failed", serviceField(inst.options.Name), instanceField(inst.id), errField(err))
 		return false
 	}
 
-	d.logger.Info("Registering service: id=%s address=%s port=%d", inst.id, d.options.Server.HTTP.Address, d.options.Server.HTTP.Port)
+	// re-registered instance has to be put back into maintenance mode
+	if status := inst.getStatus(); !status.isEnabled() {
+		if err := d.applyInstanceStatus(inst.id, status); err != nil {
+			d.logger.Warn("Setting instance status failed", serviceField(inst.options.Name), instanceField(inst.id), errField(err))
+		}
+	}
+
+	d.logger.Info("Service registered", serviceField(inst.options.Name), instanceField(inst.id))
+	return true
+}
+
+func (d *consulDiscoverySource) agentServiceRegistration(inst *consulServiceInstance) *api.AgentServiceRegistration {
+	address, err := resolveAdvertiseAddress(inst.options)
+	if err != nil {
+		// if address is not set, Consul uses agent's address
+		d.logger.Warn("Advertise address detection failed, using agent's address", serviceField(inst.options.Name), instanceField(inst.id), errField(err))
+	}
 
 	agentRegistration := api.AgentServiceRegistration{
-		Port: d.options.Server.HTTP.Port,
+		Port: inst.options.Server.HTTP.Port,
 		ID:   inst.id,
 		Name: inst.name,
 		Tags: []string{d.protocol, inst.versionTag},
 		Check: &api.AgentServiceCheck{
-			CheckID: "check-" + inst.id,
-			TTL:     strconv.FormatInt(d.options.Discovery.TTL, 10) + "s",
+			CheckID:                        "check-" + inst.id,
+			TTL:                            strconv.FormatInt(inst.options.Discovery.TTL, 10) + "s",
 			DeregisterCriticalServiceAfter: strconv.FormatInt(10, 10) + "s",
 		},
+		Meta:    make(map[string]string),
+		Connect: connectRegistration(inst),
 	}
 
-	if d.options.Server.HTTP.Address != "" {
-		agentRegistration.Address = d.options.Server.HTTP.Address
+	if address != "" {
+		agentRegistration.Address = address
 	}
 
-	err := d.client.Agent().ServiceRegister(&agentRegistration)
+	agentRegistration.Meta[environmentKey] = inst.options.Env.Name
+	agentRegistration.Meta[serviceKey] = inst.options.Name
+	for name, url := range inst.addresses {
+		agentRegistration.Meta[addressKey(name)] = url
+	}
 
-	if err != nil {
-		d.logger.Error(fmt.Sprintf("Service registration failed: %s", err.Error()))
-		return false
+	if z := inst.options.Discovery.Zone; z != "" {
+		agentRegistration.Meta[zoneKey] = z
+	}
+	if r := inst.options.Discovery.Region; r != "" {
+		agentRegistration.Meta[regionKey] = r
 	}
 
-	d.logger.Info("Service registered, id=%s", inst.id)
-	return true
-}
+	// Consul weights have to be positive, exact weight is stored in meta
+	weight := inst.getWeight()
+	agentRegistration.Meta[weightKey] = strconv.Itoa(weight)
+	if weight < 1 {
+		weight = 1
+	}
+	agentRegistration.Weights = &api.AgentWeights{
+		Passing: weight,
+		Warning: 1,
+	}
 
-func (d *consulDiscoverySource) ttlUpdate(retryDelay int64) bool {
-	inst := d.serviceInstance
-	//d.logger.Verbose("Updating TTL for service %s", inst.id)
+	return &agentRegistration
+}
 
+func (d *consulDiscoverySource) ttlUpdate(inst *consulServiceInstance, retryDelay int64) bool {
+	_, req := startBackendRequest(context.Background(), d.tracer, d.metrics, "consul", "ttl-update",
+		attrService.String(inst.options.Name), attrInstanceID.String(inst.id))
 	err := d.client.Agent().UpdateTTL(
 		"check-"+inst.id,
 		"serviceid="+inst.id+" time="+time.Now().Format("2006-01-02 15:04:05"),
 		"passing")
+	req.end(err)
 
 	if err != nil {
-		d.logger.Error("TTL update failed, error: %s, retry delay: %d ms", inst.id, err.Error(), retryDelay)
+		d.logger.Error("TTL update failed", serviceField(inst.options.Name), instanceField(inst.id), errField(err), F("retry_delay_ms", retryDelay))
 		return false
 	}
 
-	d.logger.Verbose("TTL update for service %s", inst.id)
+	d.logger.Debug("TTL update", serviceField(inst.options.Name), instanceField(inst.id))
 	return true
 }
 
+// extracts instance from service entry, returns false if instance's version can't be parsed
+func (d *consulDiscoverySource) discoveredInstance(entry *api.ServiceEntry) (discoveredService, bool) {
+	discoveredInstance := discoveredService{}
+	discoveredInstance.id = entry.Service.ID
+	if entry.Node != nil {
+		discoveredInstance.datacenter = entry.Node.Datacenter
+	}
+
+	versionOk := false
+	protocol := "http"
+	for _, tag := range entry.Service.Tags {
+		if strings.HasPrefix(tag, "version") {
+			t := strings.Split(tag, "=")
+			version, err := semver.ParseTolerant(t[1])
+			if err != nil {
+				d.logger.Warn("semver parsing failed", instanceField(discoveredInstance.id), F("version", t[1]), errField(err))
+				versionOk = false
+				break
+			}
+			discoveredInstance.version = version
+			versionOk = true
+		} else if tag == "https" {
+			protocol = "https"
+		}
+	}
+	if !versionOk {
+		return discoveredInstance, false
+	}
+	if entry.Service.Kind == api.ServiceKindConnectProxy || (entry.Service.Connect != nil && entry.Service.Connect.Native) {
+		// mesh traffic is always encrypted
+		protocol = "https"
+	}
+
+	var addr string
+	if a := entry.Service.Address; a != "" {
+		addr = a
+	} else {
+		// if address is not set, it's equal to node's address
+		addr = entry.Node.Address
+	}
+
+	discoveredInstance.directURL = fmt.Sprintf("%s://%s:%d",
+		protocol,
+		addr,
+		entry.Service.Port)
+
+	discoveredInstance.weight = 1
+	if w := entry.Service.Weights.Passing; w > 0 {
+		discoveredInstance.weight = w
+	}
+
+	for key, value := range entry.Service.Meta {
+		if key == weightKey {
+			if w, err := strconv.Atoi(value); err == nil {
+				discoveredInstance.weight = w
+			}
+		} else if key == zoneKey {
+			discoveredInstance.zone = value
+		} else if key == regionKey {
+			discoveredInstance.region = value
+		} else if key == mirroredFromKey {
+			discoveredInstance.mirroredFrom = value
+		} else if name, ok := addressName(key); ok {
+			if discoveredInstance.addresses == nil {
+				discoveredInstance.addresses = make(map[string]string)
+			}
+			discoveredInstance.addresses[name] = value
+		}
+	}
+
+	// status of instance in maintenance mode is stored as maintenance reason
+	for _, check := range entry.Checks {
+		if check.CheckID == api.ServiceMaintPrefix+entry.Service.ID && check.Status == api.HealthCritical {
+			discoveredInstance.status = InstanceStatus(check.Notes)
+		}
+	}
+
+	return discoveredInstance, true
+}
+
 // returns true if there are any services of this kind (env+name) registered
-func (d *consulDiscoverySource) isServiceRegistered() bool {
-	reg := d.serviceInstance
-	serviceEntries, _, err := d.client.Health().Service(reg.id, "", true, nil)
+func (d *consulDiscoverySource) isServiceRegistered(inst *consulServiceInstance) bool {
+	serviceEntries, _, err := d.client.Health().Service(inst.id, "", true, nil)
 
 	if err != nil {
-		d.logger.Warning("isServiceRegistered() failed: %s", err.Error())
+		d.logger.Warn("isServiceRegistered() failed", serviceField(inst.options.Name), instanceField(inst.id), errField(err))
 		return false
 	}
 
 	return len(serviceEntries) > 0
 }
 
+// removes instance with given id from instances registered by this source and returns it, or nil
+func (d *consulDiscoverySource) removeInstance(serviceID string) *consulServiceInstance {
+	d.instancesMutex.Lock()
+	defer d.instancesMutex.Unlock()
+	for i, inst := range d.serviceInstances {
+		if inst.id == serviceID {
+			d.serviceInstances = append(d.serviceInstances[:i], d.serviceInstances[i+1:]...)
+			return inst
+		}
+	}
+	return nil
+}
+
+// returns instance registered by this source with given id, or nil
+func (d *consulDiscoverySource) findInstance(serviceID string) *consulServiceInstance {
+	d.instancesMutex.Lock()
+	defer d.instancesMutex.Unlock()
+	for _, inst := range d.serviceInstances {
+		if inst.id == serviceID {
+			return inst
+		}
+	}
+	return nil
+}
+
+func (d *consulDiscoverySource) applyInstanceStatus(serviceID string, status InstanceStatus) error {
+	d.logger.Info("Setting instance status", instanceField(serviceID), F("status", status))
+	if status.isEnabled() {
+		return d.client.Agent().DisableServiceMaintenance(serviceID)
+	}
+	return d.client.Agent().EnableServiceMaintenance(serviceID, string(status))
+}
+
 // functions that aren't discoverySource methods or consulDiscoverySource methods
 
 func createConsulClient(address string) (*api.Client, error) {
@@ -366,3 +905,77 @@ func createConsulClient(address string) (*api.Client, error) {
 	}
 	return client, nil
 }
+
+// splits Consul service name into environment and service, if it matches given (optional) values
+func splitConsulServiceName(name, environment, service string) (string, string, bool) {
+	switch {
+	case environment != "":
+		if !strings.HasPrefix(name, environment+"-") {
+			return "", "", false
+		}
+		svc := strings.TrimPrefix(name, environment+"-")
+		return environment, svc, service == "" || svc == service
+	case service != "":
+		if !strings.HasSuffix(name, "-"+service) {
+			return "", "", false
+		}
+		return strings.TrimSuffix(name, "-"+service), service, true
+	default:
+		i := strings.Index(name, "-")
+		if i <= 0 {
+			return "", "", false
+		}
+		return name[:i], name[i+1:], true
+	}
+}
+
+// orders datacenters by the shortest estimated round trip time between servers of the local and of
+// the other datacenter, in the same network area. Datacenters without coordinates are tried last,
+// local datacenter is left out.
+func nearestDatacenters(local string, datacenters []string, coordinates []*api.CoordinateDatacenterMap) []string {
+	var localMaps []*api.CoordinateDatacenterMap
+	for _, dc := range coordinates {
+		if dc.Datacenter == local {
+			localMaps = append(localMaps, dc)
+		}
+	}
+
+	rtts := make(map[string]time.Duration)
+	for _, dc := range coordinates {
+		if dc.Datacenter == local {
+			continue
+		}
+		for _, localMap := range localMaps {
+			if localMap.AreaID != dc.AreaID {
+				continue // coordinates of different areas are not compatible
+			}
+			for _, a := range localMap.Coordinates {
+				for _, b := range dc.Coordinates {
+					if a.Coord == nil || b.Coord == nil {
+						continue
+					}
+					rtt := a.Coord.DistanceTo(b.Coord)
+					if current, ok := rtts[dc.Datacenter]; !ok || rtt < current {
+						rtts[dc.Datacenter] = rtt
+					}
+				}
+			}
+		}
+	}
+
+	var nearest []string
+	for _, dc := range datacenters {
+		if dc != local {
+			nearest = append(nearest, dc)
+		}
+	}
+	sort.SliceStable(nearest, func(i, j int) bool {
+		rttI, okI := rtts[nearest[i]]
+		rttJ, okJ := rtts[nearest[j]]
+		if okI != okJ {
+			return okI
+		}
+		return rttI < rttJ
+	})
+	return nearest
+}
@@ -0,0 +1,183 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/blang/semver"
+	"github.com/hashicorp/consul/api"
+)
+
+// returns instances of service found by the prepared query of discover options
+func (d *consulDiscoverySource) executePreparedQuery(ctx context.Context, options DiscoverOptions) ([]discoveredService, error) {
+	query := options.PreparedQuery
+	if query == "" {
+		query = d.generatedPreparedQuery(ctx, options)
+	}
+
+	reqCtx, req := startBackendRequest(ctx, d.tracer, d.metrics, "consul", "prepared-query")
+	response, _, err := d.client.PreparedQuery().Execute(query, (&api.QueryOptions{}).WithContext(reqCtx))
+	req.end(err)
+	if err != nil {
+		return nil, err
+	}
+	if response.Failovers > 0 {
+		d.logger.Info("Prepared query failed over", serviceField(options.Value), F("query", query), F("datacenter", response.Datacenter))
+	}
+
+	serviceEntries := make([]*api.ServiceEntry, len(response.Nodes))
+	for i := range response.Nodes {
+		serviceEntries[i] = &response.Nodes[i]
+	}
+	discoveredInstances := d.serviceEntryInstances(options, serviceEntries)
+	for i := range discoveredInstances {
+		if discoveredInstances[i].datacenter == "" {
+			discoveredInstances[i].datacenter = response.Datacenter
+		}
+	}
+	return discoveredInstances, nil
+}
+
+// returns name of the prepared query generated from discover options, which ends with a hash of
+// failover settings. Query is created on first use; if a query with the same name already exists,
+// it is updated if its definition differs.
+func (d *consulDiscoverySource) generatedPreparedQuery(ctx context.Context, options DiscoverOptions) string {
+	name := "kumuluzee-" + options.Environment + "-" + options.Value
+	var tags []string
+	if _, err := semver.Parse(options.Version); err == nil {
+		// only a single version can be matched by tag, version ranges are applied to query results
+		name += "-" + options.Version
+		tags = []string{"version=" + options.Version}
+	}
+
+	if options.ConnectMode == ConnectModeMesh {
+		name += "-connect"
+	}
+
+	// callers with different failover settings get different queries, instead of overwriting
+	// each other's definition
+	name += "-" + failoverHash(options)
+
+	d.preparedQueriesMutex.Lock()
+	defer d.preparedQueriesMutex.Unlock()
+	if d.preparedQueries[name] {
+		return name
+	}
+
+	definition := &api.PreparedQueryDefinition{
+		Name: name,
+		Service: api.ServiceQuery{
+			Service:     options.Environment + "-" + options.Value,
+			Near:        "_agent",
+			OnlyPassing: true,
+			Tags:        tags,
+			Connect:     options.ConnectMode == ConnectModeMesh,
+			Failover: api.QueryDatacenterOptions{
+				Datacenters: d.failoverDatacenters(ctx, options),
+			},
+		},
+	}
+	if err := d.savePreparedQuery(ctx, definition); err != nil {
+		// query is saved again on next discovery
+		d.logger.Warn("Saving prepared query failed", serviceField(options.Value), F("query", name), errField(err))
+		return name
+	}
+
+	if d.preparedQueries == nil {
+		d.preparedQueries = make(map[string]bool)
+	}
+	d.preparedQueries[name] = true
+	return name
+}
+
+// creates prepared query, or updates the existing query with the same name if its service query
+// differs
+func (d *consulDiscoverySource) savePreparedQuery(ctx context.Context, definition *api.PreparedQueryDefinition) error {
+	_, req := startBackendRequest(ctx, d.tracer, d.metrics, "consul", "prepared-query-list")
+	queries, _, err := d.client.PreparedQuery().List(nil)
+	req.end(err)
+	if err != nil {
+		return err
+	}
+
+	for _, query := range queries {
+		if query.Name != definition.Name {
+			continue
+		}
+		if sameServiceQuery(query.Service, definition.Service) {
+			return nil
+		}
+		definition.ID = query.ID
+		_, req := startBackendRequest(ctx, d.tracer, d.metrics, "consul", "prepared-query-update")
+		_, err := d.client.PreparedQuery().Update(definition, nil)
+		req.end(err)
+		if err == nil {
+			d.logger.Info("Updated prepared query", F("query", definition.Name), F("query_id", query.ID))
+		}
+		return err
+	}
+
+	_, req = startBackendRequest(ctx, d.tracer, d.metrics, "consul", "prepared-query-create")
+	id, _, err := d.client.PreparedQuery().Create(definition, nil)
+	req.end(err)
+	if err == nil {
+		d.logger.Info("Created prepared query", F("query", definition.Name), F("query_id", id))
+	}
+	return err
+}
+
+// returns a short, stable hash of datacenter failover settings of discover options
+func failoverHash(options DiscoverOptions) string {
+	h := fnv.New32a()
+	h.Write([]byte(options.DatacenterFailover))
+	for _, dc := range options.Datacenters {
+		h.Write([]byte{0})
+		h.Write([]byte(dc))
+	}
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// compares service queries in fields set by generated prepared queries
+func sameServiceQuery(a, b api.ServiceQuery) bool {
+	return a.Service == b.Service &&
+		a.Near == b.Near &&
+		a.OnlyPassing == b.OnlyPassing &&
+		a.Connect == b.Connect &&
+		sameStrings(a.Tags, b.Tags) &&
+		sameStrings(a.Failover.Datacenters, b.Failover.Datacenters)
+}
+
+// compares string slices, nil and empty slices are equal
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
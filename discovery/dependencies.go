@@ -0,0 +1,261 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mc0239/kumuluzee-go-config/config"
+)
+
+// DependencyState is a state of a dependency, as reported by Util.Dependencies.
+type DependencyState struct {
+	Environment string `json:"environment,omitempty"`
+	Service     string `json:"service"`
+	Version     string `json:"version,omitempty"`
+	// Resolved is true if the last discovery of the dependency succeeded.
+	Resolved bool `json:"resolved"`
+	// URL found by the last successful discovery.
+	URL string `json:"url,omitempty"`
+	// Error of the last discovery, if it failed.
+	Error        string     `json:"error,omitempty"`
+	LastAttempt  *time.Time `json:"lastAttempt,omitempty"`
+	LastResolved *time.Time `json:"lastResolved,omitempty"`
+}
+
+// unresolved dependencies are retried after this delay, which doubles up to the refresh interval
+const dependencyRetryDelay = time.Second
+
+// default interval in which dependencies are rediscovered
+const defaultDependencyRefreshInterval = 30 * time.Second
+
+// discovers dependencies on start and periodically afterwards, so that discovery caches stay warm
+type dependencyTracker struct {
+	util         Util
+	dependencies []DiscoverOptions
+	interval     time.Duration
+
+	mutex   sync.Mutex
+	states  []DependencyState
+	changed chan struct{} // closed and replaced whenever states change
+
+	stopOnce sync.Once
+	stopped  chan struct{} // closed when tracking is stopped
+}
+
+// returns dependencies from Options and configuration list kumuluzee.discovery.dependencies, and
+// their refresh interval
+func loadDependencies(conf config.Util, options Options) ([]DiscoverOptions, time.Duration) {
+	// Load default values
+	interval := defaultDependencyRefreshInterval
+
+	// Load from configuration file, overriding defaults
+	var dependencies []DiscoverOptions
+	if items, ok := conf.Get("kumuluzee.discovery.dependencies").([]interface{}); ok {
+		for _, item := range items {
+			dependency := DiscoverOptions{
+				Value:       configItemString(item, "name"),
+				Environment: configItemString(item, "environment"),
+				Version:     configItemString(item, "version"),
+				AccessType:  configItemString(item, "access-type"),
+			}
+			if dependency.Value != "" {
+				dependencies = append(dependencies, dependency)
+			}
+		}
+	}
+	if v, ok := conf.GetInt("kumuluzee.discovery.dependencies-refresh-interval-ms"); ok {
+		interval = time.Duration(v) * time.Millisecond
+	}
+
+	// Load from Options, extending file configuration
+	dependencies = append(dependencies, options.Dependencies...)
+	if options.DependencyRefreshInterval != 0 {
+		interval = options.DependencyRefreshInterval
+	}
+
+	if interval <= 0 {
+		// dependencies would be rediscovered in a busy loop
+		interval = defaultDependencyRefreshInterval
+	}
+
+	return dependencies, interval
+}
+
+// returns string value of given key of a configuration list item, or an empty string
+func configItemString(item interface{}, key string) string {
+	var value interface{}
+	switch m := item.(type) {
+	case map[string]interface{}:
+		value = m[key]
+	case map[interface{}]interface{}:
+		value = m[key]
+	}
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+func newDependencyTracker(util Util, dependencies []DiscoverOptions, interval time.Duration) *dependencyTracker {
+	t := &dependencyTracker{
+		util:         util,
+		dependencies: dependencies,
+		interval:     interval,
+		states:       make([]DependencyState, len(dependencies)),
+		changed:      make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	for i, dependency := range dependencies {
+		t.states[i] = DependencyState{
+			Environment: dependency.Environment,
+			Service:     dependency.Value,
+			Version:     dependency.Version,
+		}
+	}
+	return t
+}
+
+// discovers dependencies until tracking is stopped. Unresolved dependencies are retried sooner.
+func (t *dependencyTracker) run() {
+	delay := dependencyRetryDelay
+	for {
+		if t.discover() {
+			delay = t.interval
+		} else if delay *= 2; delay > t.interval {
+			delay = t.interval
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-t.stopped:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// stops rediscovering dependencies, can be called more than once
+func (t *dependencyTracker) stop() {
+	t.stopOnce.Do(func() {
+		close(t.stopped)
+	})
+}
+
+// discovers all dependencies, returns true if all of them are resolved
+func (t *dependencyTracker) discover() bool {
+	allResolved := true
+	for i, dependency := range t.dependencies {
+		ctx, stale := withStaleFlag(context.Background())
+		url, err := t.util.DiscoverServiceContext(ctx, dependency)
+		if err == nil && *stale {
+			// the dependency may have no instances at all
+			err = fmt.Errorf("no instances discovered, only last known service %s is available", url)
+		}
+		now := time.Now()
+
+		t.mutex.Lock()
+		state := &t.states[i]
+		wasResolved, firstAttempt := state.Resolved, state.LastAttempt == nil
+		state.LastAttempt = &now
+		if err == nil {
+			state.Resolved = true
+			state.URL = url
+			state.Error = ""
+			state.LastResolved = &now
+		} else {
+			state.Resolved = false
+			state.Error = err.Error()
+			allResolved = false
+		}
+		close(t.changed)
+		t.changed = make(chan struct{})
+		t.mutex.Unlock()
+
+		if err == nil && !wasResolved {
+			t.util.Logger.Info("Dependency discovered", serviceField(dependency.Value), F("url", url))
+		} else if err != nil && (wasResolved || firstAttempt) {
+			// failures are only logged when the state changes, retries would flood the log
+			t.util.Logger.Warn("Dependency discovery failed", serviceField(dependency.Value), errField(err))
+		}
+	}
+	return allResolved
+}
+
+// returns names of unresolved dependencies and a channel, which is closed when states change
+func (t *dependencyTracker) unresolved() ([]string, chan struct{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var names []string
+	for _, state := range t.states {
+		if !state.Resolved {
+			names = append(names, state.Service)
+		}
+	}
+	return names, t.changed
+}
+
+func (t *dependencyTracker) snapshot() []DependencyState {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]DependencyState{}, t.states...)
+}
+
+// WaitForDependencies blocks until all of dependencies, declared with Options.Dependencies or
+// configuration list kumuluzee.discovery.dependencies, are discovered, or until ctx is done. It
+// can be used as a readiness gate. Returns nil immediately if there are no dependencies. Example:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+//	defer cancel()
+//	if err := disc.WaitForDependencies(ctx); err != nil {
+//		log.Fatal(err)
+//	}
+func (d Util) WaitForDependencies(ctx context.Context) error {
+	if d.dependencies == nil {
+		return nil
+	}
+	for {
+		unresolved, changed := d.dependencies.unresolved()
+		if len(unresolved) == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("dependencies not discovered (%s): %w", strings.Join(unresolved, ", "), ctx.Err())
+		}
+	}
+}
+
+// Dependencies returns states of dependencies, declared with Options.Dependencies or configuration
+// list kumuluzee.discovery.dependencies, in order of declaration.
+func (d Util) Dependencies() []DependencyState {
+	if d.dependencies == nil {
+		return []DependencyState{}
+	}
+	return d.dependencies.snapshot()
+}
@@ -0,0 +1,136 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mc0239/logm"
+	"go.etcd.io/etcd/client"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// etcd keys API serving fixed nodes, keys can't be changed
+type staticKeysAPI struct {
+	client.KeysAPI
+	nodes map[string]*client.Node
+}
+
+func (k *staticKeysAPI) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	node, ok := k.nodes[key]
+	if !ok {
+		return nil, client.Error{Code: client.ErrorCodeKeyNotFound, Message: "Key not found", Cause: key}
+	}
+	return &client.Response{Action: "get", Node: node}, nil
+}
+
+func (k *staticKeysAPI) Watcher(key string, opts *client.WatcherOptions) client.Watcher {
+	return blockingWatcher{}
+}
+
+// watcher without changes
+type blockingWatcher struct{}
+
+func (blockingWatcher) Next(ctx context.Context) (*client.Response, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// returns a service directory node with an instance of version 1.0.0
+func serviceNode(environment, service, url string) *client.Node {
+	dir := serviceNamespace(environment, service)
+	return &client.Node{Key: dir, Dir: true, Nodes: client.Nodes{
+		{Key: dir + "/1.0.0", Dir: true, Nodes: client.Nodes{
+			{Key: dir + "/1.0.0/instances", Dir: true, Nodes: client.Nodes{
+				{Key: dir + "/1.0.0/instances/instance-1", Dir: true, Nodes: client.Nodes{
+					{Key: dir + "/1.0.0/instances/instance-1/url", Value: url},
+				}},
+			}},
+		}},
+	}}
+}
+
+func newTestEtcdUtil(t *testing.T, keys *staticKeysAPI) Util {
+	l := logm.New("KumuluzEE-discovery")
+	l.LogLevel = logm.LvlMute
+	logger := NewLogmLogger(&l)
+	tracer := noop.NewTracerProvider().Tracer("")
+
+	d := &etcdDiscoverySource{
+		kvClient: keys,
+		cache:    newDiscoveryCache("etcd", nil),
+		outliers: newOutlierDetector(CircuitBreakerOptions{Disabled: true}),
+		logger:   logger,
+		tracer:   tracer,
+	}
+	d.ctx, d.stop = context.WithCancel(context.Background())
+	t.Cleanup(d.stop)
+
+	return Util{
+		discoverySource: d,
+		Logger:          logger,
+		outliers:        d.outliers,
+		tracer:          tracer,
+	}
+}
+
+func TestDependenciesWithoutInstancesAreUnresolved(t *testing.T) {
+	keys := &staticKeysAPI{nodes: map[string]*client.Node{
+		"environments/dev/services/customer-service/": serviceNode("dev", "customer-service", "http://customers:8080"),
+	}}
+	util := newTestEtcdUtil(t, keys)
+	tracker := newDependencyTracker(util, []DiscoverOptions{
+		{Value: "customer-service", Environment: "dev"},
+		{Value: "order-service", Environment: "dev"},
+	}, time.Minute)
+
+	// order-service must not be resolved with the URL of customer-service
+	for i := 0; i < 2; i++ {
+		if tracker.discover() {
+			t.Fatalf("discovery %d: order-service without instances resolved", i)
+		}
+		states := tracker.snapshot()
+		if !states[0].Resolved || states[0].URL != "http://customers:8080" {
+			t.Errorf("discovery %d: customer-service state = %+v, want resolved with its URL", i, states[0])
+		}
+		if states[1].Resolved || states[1].URL != "" {
+			t.Errorf("discovery %d: order-service state = %+v, want unresolved without URL", i, states[1])
+		}
+	}
+	if unresolved, _ := tracker.unresolved(); len(unresolved) != 1 || unresolved[0] != "order-service" {
+		t.Errorf("unresolved = %v, want [order-service]", unresolved)
+	}
+
+	// the last known service is still returned, but the dependency is no longer resolved
+	delete(keys.nodes, "environments/dev/services/customer-service/")
+	tracker.discover()
+	state := tracker.snapshot()[0]
+	if state.Resolved || !strings.Contains(state.Error, "last known service") {
+		t.Errorf("customer-service state = %+v, want unresolved with last known service", state)
+	}
+	if url, err := util.DiscoverService(DiscoverOptions{Value: "customer-service", Environment: "dev"}); err != nil || url != "http://customers:8080" {
+		t.Errorf("DiscoverService() = %q, %v, want last known service", url, err)
+	}
+}
@@ -23,21 +23,67 @@
 package discovery
 
 import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/mc0239/kumuluzee-go-config/config"
 	"github.com/mc0239/logm"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Options struct is used when instantiating a new Util.
 type Options struct {
 	// Additional configuration source to connect to. Possible values are: "consul", "etcd"
 	Extension string
+	// Extensions, if set, are used instead of Extension to connect to several discovery sources at
+	// once, e.g. []string{"consul", "etcd"}. Services are registered with all of them and discovered
+	// according to MultiDiscovery.
+	Extensions []string
+	// MultiDiscovery defines how services are discovered when multiple Extensions are set.
+	// Supported values are discovery.MultiDiscovery* constants.
+	// Default value is discovery.MultiDiscoveryPriority, which uses Extensions in given order.
+	MultiDiscovery string
 	// ConfigPath is a path to configuration file, including the configuration file name.
 	// Passing an empty string will default to config/config.yaml
 	ConfigPath string
 	// LogLevel can be used to limit the amount of logging output. Default log level is 0. Level 4
 	// will only output Warnings and Errors, and level 5 will only output errors.
 	// See package github.com/mc0239/logm for more details on logging and log levels.
+	// LogLevel only applies to the default logger and is ignored if Logger is set.
 	LogLevel int
+	// Logger, if set, is used instead of the default logm logger. See packages slogadapter,
+	// zapadapter and zerologadapter for adapters of popular logging libraries.
+	Logger Logger
+	// CircuitBreaker configures per-instance circuit breakers and outlier ejection.
+	// Zero values are replaced by configuration or default values, see CircuitBreakerOptions.
+	CircuitBreaker CircuitBreakerOptions
+	// Metrics, if set, collects metrics of service registration and discovery. See NewMetrics.
+	Metrics *Metrics
+	// TracerProvider, if set, is used to trace service registration, discovery and requests to the
+	// discovery source with OpenTelemetry. See Util.DiscoverServiceContext.
+	TracerProvider trace.TracerProvider
+	// CacheFile, if set, is a path of a file, which the discovery cache (instances and gateway URLs
+	// of discovered services) is persisted to. Cache is loaded from the file on start and used when
+	// discovery fails, e.g. when the registry is down while the process starts.
+	// Can be overridden with configuration key kumuluzee.discovery.cache.file
+	CacheFile string
+	// CacheMaxAge is the maximal age of cached instances, used when discovery fails.
+	// Default value is 24 hours.
+	// Can be overridden with configuration key kumuluzee.discovery.cache.max-age-ms
+	CacheMaxAge time.Duration
+	// Dependencies are services the discovering service depends on. They are discovered when
+	// discovery.Util is created and rediscovered periodically afterwards, so that the first request
+	// to a dependency does not wait for discovery. See Util.WaitForDependencies.
+	// Dependencies are added to configuration list kumuluzee.discovery.dependencies, with items
+	// having keys name, environment, version and access-type.
+	Dependencies []DiscoverOptions
+	// DependencyRefreshInterval is an interval in which dependencies are rediscovered, until
+	// Util.DeregisterService or Util.GracefulShutdown is called.
+	// Default value is 30 seconds, which is also used if the interval is not positive.
+	// Can be overridden with configuration key kumuluzee.discovery.dependencies-refresh-interval-ms
+	DependencyRefreshInterval time.Duration
 }
 
 // RegisterOptions is used when registering a service
@@ -64,6 +110,28 @@ type RegisterOptions struct {
 	// If set to true, only once instance of service with the same name, version and environment is registered.
 	// Default value is false.
 	Singleton bool
+	// Additional named addresses (URLs) of the service, keyed by access type, e.g.
+	// {"container": "http://172.17.0.2:8080"}. Direct address is set with configuration key
+	// kumuluzee.server.base-url or detected automatically and should not be set here.
+	// Container, internal and external addresses can also be set with configuration keys
+	// kumuluzee.server.container-url, kumuluzee.server.internal-url and kumuluzee.server.external-url
+	Addresses map[string]string
+	// Weight of the instance, used by service discovery to distribute traffic unevenly. Instance with
+	// weight 2 receives twice as much traffic as instance with weight 1. Can be changed at runtime
+	// with Util.SetInstanceWeight.
+	// Default value is 1.
+	// Can be overridden with configuration key kumuluzee.discovery.weight
+	Weight int
+	// Availability zone and region of the instance, used by service discovery to prefer
+	// same-zone instances.
+	// If values are not provided, they are read from configuration keys kumuluzee.discovery.zone and
+	// kumuluzee.discovery.region, or from environment variables ZONE or AVAILABILITY_ZONE and
+	// REGION, AWS_REGION or AWS_DEFAULT_REGION.
+	Zone   string
+	Region string
+	// Connect registers the service into Consul Connect service mesh, either as Connect-native or
+	// with a sidecar proxy. Only supported by Consul.
+	Connect *ConnectOptions
 }
 
 // DiscoverOptions is used when discovering services
@@ -74,79 +142,341 @@ type DiscoverOptions struct {
 	// If value is not provided, it uses value from configuration with key kumuluzee.env.name
 	// If value is not specified and key in configuration does not exists, value defaults to 'dev'.
 	Environment string
+	// FallbackEnvironments is an ordered list of environments, which are tried if there is no usable
+	// instance in Environment, e.g. []string{"staging", "shared"}. Instances are discovered in the
+	// first environment that has any.
+	// Can be overridden with configuration key kumuluzee.discovery.fallback-environments, a
+	// comma-separated list of environments.
+	FallbackEnvironments []string
 	// Version of the service to discover.
-	// Supported values are semantic version (semver) parseable versions/version ranges.
+	// Supported values are semantic versions and npm version ranges, e.g. "^1.2.0", "1.x || 2.x".
 	// Default value is "*", which resolves to highest deployed version.
 	Version string
+	// IncludePrerelease makes prerelease versions (e.g. 2.0.0-rc.1) match version ranges like any
+	// other version. By default, prerelease version only matches if the range explicitly contains a
+	// prerelease of the same major.minor.patch version, e.g. ">=2.0.0-rc.0".
+	IncludePrerelease bool
 	// AccessType defines, which URL gets injected.
-	// Supported values are constants discovery.AccessTypeGateway and discovery.AccessTypeDirect.
-	// Default value is discovery.AccessTypeGateway.
+	// Supported values are discovery.AccessType* constants and names of custom addresses, set with
+	// RegisterOptions.Addresses.
+	// Default value is discovery.AccessTypeGateway, which falls back to discovery.AccessTypeDirect.
 	AccessType string
+	// AccessTypes is an ordered list of preferred access types, e.g. []string{"container", "direct"}.
+	// First access type for which discovered instance has an URL is used. If set, AccessType is ignored.
+	AccessTypes []string
+	// Zone and Region of the discovering service. Instances in the same zone are preferred, then
+	// instances in the same region, then all of instances.
+	// If values are not provided, they are detected the same way as in RegisterOptions.
+	Zone   string
+	Region string
+	// ZoneSpilloverThreshold is a minimal share (between 0 and 1) of total capacity (sum of
+	// weights) that same-zone instances must have, for traffic to stay in the same zone. Below the
+	// threshold, traffic spills over to other zones. Same-zone instances are always skipped if there
+	// are none.
+	// Default value is 0.
+	// Can be overridden with configuration key kumuluzee.discovery.zone-spillover-threshold
+	ZoneSpilloverThreshold float64
+	// VersionPolicy defines, which of versions in range are discovered.
+	// Supported values are discovery.VersionPolicy* constants.
+	// Versions without usable instances are always skipped, e.g. with discovery.VersionPolicyLatest,
+	// the next highest version is discovered if the latest version has no healthy instances.
+	// Default value is discovery.VersionPolicyLatest.
+	VersionPolicy string
+	// PinnedVersion is discovered with discovery.VersionPolicyPinned, if it is in version range and
+	// has usable instances.
+	PinnedVersion string
+	// StickyKey, if set, makes traffic split assignment sticky: selections with the same key (e.g.
+	// user id) are always assigned to the same version range. See Util.SetTrafficSplit.
+	StickyKey string
+	// Datacenters is an ordered list of Consul datacenters, which are tried if no usable instance
+	// is found in the local datacenter. Instances are discovered in the first datacenter that has
+	// any. Only supported by Consul.
+	Datacenters []string
+	// DatacenterFailover defines, which datacenters are tried after the local one.
+	// Supported values are discovery.DatacenterFailover* constants.
+	// Default value is discovery.DatacenterFailoverListed.
+	// Can be overridden with configuration key kumuluzee.discovery.consul.datacenter-failover
+	DatacenterFailover string
+	// PreparedQuery is a name or ID of a Consul prepared query, which is executed instead of a health
+	// query of the service. The query should return instances of the service, given by Value and
+	// Environment. Failover is left to the query, Datacenters and DatacenterFailover are ignored.
+	// Only supported by Consul.
+	PreparedQuery string
+	// GeneratePreparedQuery makes discovery use a prepared query generated from Value, Environment,
+	// Version (if it is a single version), Datacenters, DatacenterFailover and ConnectMode, if
+	// PreparedQuery is not set. Query is named kumuluzee-'environment'-'name'[-'version'][-connect]
+	// and is created on first use, unless it already exists. Only supported by Consul.
+	// Can be overridden with configuration key kumuluzee.discovery.consul.generate-prepared-queries
+	GeneratePreparedQuery bool
+	// ConnectMode makes discovery Consul Connect aware.
+	// Supported values are discovery.ConnectMode* constants. By default, services are discovered
+	// directly, bypassing the mesh. Only supported by Consul.
+	ConnectMode string
 }
 
 // Possible access types for DiscoverOptions.AccessType
 const (
-	AccessTypeDirect  = "direct"
-	AccessTypeGateway = "gateway"
+	AccessTypeDirect    = "direct"
+	AccessTypeGateway   = "gateway"
+	AccessTypeContainer = "container"
+	AccessTypeInternal  = "internal"
+	AccessTypeExternal  = "external"
+)
+
+// Possible datacenter failover policies for DiscoverOptions.DatacenterFailover
+const (
+	// Only DiscoverOptions.Datacenters are tried, in given order.
+	DatacenterFailoverListed = "listed"
+	// DiscoverOptions.Datacenters, or all of known datacenters if none are listed, are tried
+	// ordered by estimated round trip time from the local datacenter, based on Consul's network
+	// coordinates.
+	DatacenterFailoverNearest = "nearest"
 )
 
+// Possible version policies for DiscoverOptions.VersionPolicy
+const (
+	// Only the latest version in range is discovered.
+	VersionPolicyLatest = "latest"
+	// All of versions in range are discovered.
+	VersionPolicyAllInRange = "all-in-range"
+	// The latest version of each major version in range is discovered.
+	VersionPolicyLatestMajorSpread = "latest-major-spread"
+	// DiscoverOptions.PinnedVersion is discovered, falling back to the latest version in range.
+	VersionPolicyPinned = "pinned"
+)
+
+// InstanceStatus is a status of a registered service instance. Only enabled instances are
+// returned by service discovery.
+type InstanceStatus string
+
+// Possible instance statuses for Util.SetInstanceStatus
+const (
+	InstanceEnabled  InstanceStatus = "enabled"
+	InstanceDisabled InstanceStatus = "disabled"
+	// Draining instances are taken out of rotation before being deregistered.
+	InstanceDraining InstanceStatus = "draining"
+)
+
+// instances without a status (e.g. registered by older versions) are enabled
+func (s InstanceStatus) isEnabled() bool {
+	return s == "" || s == InstanceEnabled
+}
+
+func (s InstanceStatus) isValid() bool {
+	return s == InstanceEnabled || s == InstanceDisabled || s == InstanceDraining
+}
+
+// GatewayURL holds a gateway URL of a service version in an environment.
+type GatewayURL struct {
+	Environment string
+	Service     string
+	Version     string
+	URL         string
+	// MirroredFrom is the backend (e.g. "etcd") the gateway URL is copied from by Mirror, or empty.
+	MirroredFrom string
+}
+
 // Util is used for registering and discovering services from a service discovery source.
 // Util should be initialized with discovery.New() function
 type Util struct {
 	discoverySource discoverySource
-	Logger          logm.Logm
+	Logger          Logger
+
+	extension string
+	outliers  *outlierDetector
+	metrics   *Metrics
+	tracer    trace.Tracer
+
+	dependencies *dependencyTracker // nil if there are no dependencies
 }
 
 type discoverySource interface {
 	RegisterService(options RegisterOptions) (serviceID string, err error)
 	DeregisterService() error
-	DiscoverService(options DiscoverOptions) (string, error)
+	DiscoverService(ctx context.Context, options DiscoverOptions) (string, error)
+
+	SetInstanceStatus(serviceID string, status InstanceStatus) error
+	SetInstanceWeight(serviceID string, weight int) error
+	RegisteredServiceIDs() []string
+
+	SetKey(key, value string) error
+	DeleteKey(key string) error
+	ListGatewayURLs(environment string) ([]GatewayURL, error)
+
+	ListInstances(environment, service string) ([]Instance, error)
+	RegisterStaticInstance(instance StaticInstance) (string, error)
+	DeregisterInstance(environment, service, instanceID string) error
+
+	// resets TTL of a static instance, registered with StaticInstance.TTL
+	refreshStaticInstance(instance StaticInstance) error
+
+	adminState() sourceState
 }
 
 // New instantiates Util struct with initialized service discovery
 func New(options Options) Util {
 
-	lgr := logm.New("KumuluzEE-discovery")
-	lgr.LogLevel = options.LogLevel
+	lgr := options.Logger
+	if lgr == nil {
+		l := logm.New("KumuluzEE-discovery")
+		l.LogLevel = options.LogLevel
+		lgr = NewLogmLogger(&l)
+	}
 
-	var src discoverySource
+	conf := config.NewUtil(config.Options{
+		ConfigPath: options.ConfigPath,
+		LogLevel:   logm.LvlWarning, // bit less logs from config
+	})
+	outliers := newOutlierDetector(loadCircuitBreakerOptions(conf, options.CircuitBreaker))
+	tracer := newTracer(options.TracerProvider)
+
+	var snapshot *cacheSnapshot
+	if file, maxAge := loadCacheFileOptions(conf, options); file != "" {
+		snapshot = loadCacheSnapshot(file, maxAge, lgr)
+	}
 
-	if options.Extension == "consul" {
-		// TODO: potential mixup between cofig.Options and (discovery.)Options
-		src = newConsulDiscoverySource(config.Options{
-			Extension:  options.Extension,
-			ConfigPath: options.ConfigPath,
-			LogLevel:   options.LogLevel,
-		}, &lgr)
-	} else if options.Extension == "etcd" {
-		src = newEtcdDiscoverySource(config.Options{
-			Extension:  options.Extension,
-			ConfigPath: options.ConfigPath,
-			LogLevel:   options.LogLevel,
-		}, &lgr)
-	} else {
-		lgr.Error("Specified discovery source extension is invalid.")
+	extensions := options.Extensions
+	if len(extensions) == 0 {
+		extensions = []string{options.Extension}
+	}
+
+	var sources []instanceSource
+	for _, extension := range extensions {
+		if src := newDiscoverySource(extension, options, lgr, outliers, tracer, snapshot); src != nil {
+			sources = append(sources, src)
+		}
+	}
+
+	var src discoverySource
+	if len(sources) == 1 {
+		src = sources[0]
+	} else if len(sources) > 1 {
+		src = newMultiDiscoverySource(extensions, sources, options.MultiDiscovery, loadDiscoverConfiguration(conf),
+			outliers, lgr, options.Metrics)
 	}
 
 	k := Util{
-		src,
-		lgr,
+		discoverySource: src,
+		Logger:          lgr,
+		extension:       strings.Join(extensions, ","),
+		outliers:        outliers,
+		metrics:         options.Metrics,
+		tracer:          tracer,
+	}
+
+	if dependencies, interval := loadDependencies(conf, options); len(dependencies) > 0 && src != nil {
+		k.dependencies = newDependencyTracker(k, dependencies, interval)
+		go k.dependencies.run()
 	}
 
 	return k
 }
 
+// returns discovery source of given extension, or nil if extension is invalid or the discovery
+// source can't be initialized
+func newDiscoverySource(extension string, options Options, lgr Logger, outliers *outlierDetector, tracer trace.Tracer, snapshot *cacheSnapshot) instanceSource {
+	// TODO: potential mixup between cofig.Options and (discovery.)Options
+	cfgOpts := config.Options{
+		Extension:  extension,
+		ConfigPath: options.ConfigPath,
+		LogLevel:   options.LogLevel,
+	}
+	switch extension {
+	case "consul":
+		return newConsulDiscoverySource(cfgOpts, lgr, outliers, options.Metrics, tracer, snapshot)
+	case "etcd":
+		return newEtcdDiscoverySource(cfgOpts, lgr, outliers, options.Metrics, tracer, snapshot)
+	default:
+		lgr.Error("Specified discovery source extension is invalid.", F("extension", extension))
+		return nil
+	}
+}
+
 // RegisterService registers service using service discovery client with given RegisterOptions
 func (d Util) RegisterService(options RegisterOptions) (string, error) {
-	return d.discoverySource.RegisterService(options)
+	_, span := d.tracer.Start(context.Background(), "RegisterService",
+		trace.WithAttributes(attrService.String(options.Value)))
+	serviceID, err := d.discoverySource.RegisterService(options)
+	span.SetAttributes(attrInstanceID.String(serviceID))
+	endSpan(span, err)
+	return serviceID, err
 }
 
-// DeregisterService removes service from the registry (deregisters).
+// DeregisterService removes all services, registered with this Util, from the registry (deregisters).
+// Dependencies are no longer rediscovered afterwards.
 func (d Util) DeregisterService() error {
+	if d.dependencies != nil {
+		d.dependencies.stop()
+	}
 	return d.discoverySource.DeregisterService()
 }
 
 // DiscoverService discovery services using service discovery client with given RegisterOptions
 func (d Util) DiscoverService(options DiscoverOptions) (string, error) {
-	return d.discoverySource.DiscoverService(options)
+	return d.DiscoverServiceContext(context.Background(), options)
+}
+
+// DiscoverServiceContext is like DiscoverService, but traces the discovery as a child span of the
+// span in given context.
+func (d Util) DiscoverServiceContext(ctx context.Context, options DiscoverOptions) (string, error) {
+	ctx, span := d.tracer.Start(ctx, "DiscoverService",
+		trace.WithAttributes(attrService.String(options.Value)))
+	start := time.Now()
+	service, err := d.discoverySource.DiscoverService(ctx, options)
+	d.metrics.observeDiscovery(options.Value, err, start)
+	span.SetAttributes(attrInstanceURL.String(service))
+	endSpan(span, err)
+	return service, err
+}
+
+// SetInstanceStatus sets status of a service instance with given id. Disabled and draining
+// instances are skipped by service discovery, but stay registered.
+// With Consul, status is set using maintenance mode, therefore the instance has to be registered
+// with the same Consul agent.
+func (d Util) SetInstanceStatus(serviceID string, status InstanceStatus) error {
+	if !status.isValid() {
+		return fmt.Errorf("invalid instance status: %s", status)
+	}
+	return d.discoverySource.SetInstanceStatus(serviceID, status)
+}
+
+// SetInstanceWeight changes weight of a service instance with given id. Weight 0 takes the instance
+// out of rotation, unless all other instances also have weight 0, which can be used for gradual
+// warm-up of fresh instances.
+// With Consul, only instances registered with this Util can be updated.
+func (d Util) SetInstanceWeight(serviceID string, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("invalid instance weight: %d", weight)
+	}
+	return d.discoverySource.SetInstanceWeight(serviceID, weight)
+}
+
+// SetGatewayURL sets gateway URL of a service version in the registry. Services discovering it with
+// access type discovery.AccessTypeGateway are updated automatically.
+func (d Util) SetGatewayURL(environment, service, version, url string) error {
+	namespace := serviceVersionNamespace(environment, service, version)
+	key := namespace + "/" + gatewayURLKey
+	d.Logger.Info("Setting gatewayUrl", F("key", key), F("gateway_url", url))
+	if err := d.discoverySource.SetKey(key, url); err != nil {
+		return err
+	}
+	// gateway URL is no longer the one copied by Mirror
+	return d.discoverySource.DeleteKey(namespace + "/" + gatewayURLMirroredFromKey)
+}
+
+// ClearGatewayURL removes gateway URL of a service version from the registry.
+func (d Util) ClearGatewayURL(environment, service, version string) error {
+	namespace := serviceVersionNamespace(environment, service, version)
+	key := namespace + "/" + gatewayURLKey
+	d.Logger.Info("Clearing gatewayUrl", F("key", key))
+	if err := d.discoverySource.DeleteKey(key); err != nil {
+		return err
+	}
+	return d.discoverySource.DeleteKey(namespace + "/" + gatewayURLMirroredFromKey)
+}
+
+// ListGatewayURLs returns all gateway URLs set in given environment.
+// If environment is an empty string, gateway URLs of all environments are returned.
+func (d Util) ListGatewayURLs(environment string) ([]GatewayURL, error) {
+	return d.discoverySource.ListGatewayURLs(environment)
 }
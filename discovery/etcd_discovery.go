@@ -23,9 +23,16 @@ package discovery
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/blang/semver"
@@ -34,6 +41,7 @@ import (
 	"github.com/mc0239/logm"
 	uuid "github.com/satori/go.uuid"
 	"go.etcd.io/etcd/client"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // holds etcd client instance and configuration
@@ -43,32 +51,50 @@ type etcdDiscoverySource struct {
 
 	startRetryDelay int64
 	maxRetryDelay   int64
-
-	configOptions   config.Options         // passed when calling new...()
-	options         *registerConfiguration // loaded as config bundle
-	serviceInstance *etcdServiceInstance
-
-	lastKnownService string // last known service from discovery
-	gatewayURLs      []*gatewayURLWatch
-
-	logger *logm.Logm
+	protocol        string
+
+	configOptions    config.Options        // passed when calling new...()
+	discoverOptions  discoverConfiguration // loaded when calling new...()
+	serviceInstances []*etcdServiceInstance
+	instancesMutex   sync.Mutex
+
+	lastKnownServices lastKnownServices // last known service of each discovered service
+	cache             *discoveryCache   // instances found by last discovery of each service
+	gatewayURLs       gatewayURLWatchList
+	trafficSplits     trafficSplitWatches
+	outliers          *outlierDetector // shared with Util
+
+	// cancelled on deregistration, stops endpoint auto-sync and key watches
+	ctx  context.Context
+	stop context.CancelFunc
+
+	logger  Logger
+	metrics *Metrics
+	tracer  trace.Tracer
 }
 
 // holds service instance configuration and state
 type etcdServiceInstance struct {
-	isRegistered bool
+	instanceState
 
+	options    *registerConfiguration // loaded as config bundle
 	id         string
 	etcdKeyDir string
 	serviceURL string
+	addresses  map[string]string
 
 	singleton bool
 }
 
-func newEtcdDiscoverySource(options config.Options, logger *logm.Logm) discoverySource {
+func newEtcdDiscoverySource(options config.Options, logger Logger, outliers *outlierDetector, metrics *Metrics, tracer trace.Tracer, snapshot *cacheSnapshot) instanceSource {
 	var d etcdDiscoverySource
-	logger.Verbose("Initializing etcd discovery source")
+	logger = withFields(logger, F(FieldBackend, "etcd"))
+	logger.Debug("Initializing etcd discovery source")
 	d.logger = logger
+	d.outliers = outliers
+	d.metrics = metrics
+	d.tracer = tracer
+	d.cache = newDiscoveryCache("etcd", snapshot)
 
 	d.configOptions = options
 	conf := config.NewUtil(config.Options{
@@ -76,22 +102,36 @@ func newEtcdDiscoverySource(options config.Options, logger *logm.Logm) discovery
 		LogLevel:   logm.LvlWarning, // bit less logs from config
 	})
 
+	d.discoverOptions = loadDiscoverConfiguration(conf)
+
 	startRD, maxRD := getRetryDelays(conf)
 	d.startRetryDelay = startRD
 	d.maxRetryDelay = maxRD
-	logger.Verbose("start-retry-delay-ms=%d, max-retry-delay-ms=%d", d.startRetryDelay, d.maxRetryDelay)
+	logger.Debug("Retry delays set", F("start_retry_delay_ms", d.startRetryDelay), F("max_retry_delay_ms", d.maxRetryDelay))
 
-	var etcdAddresses string
-	if addr, ok := conf.GetString("kumuluzee.discovery.etcd.hosts"); ok {
-		etcdAddresses = addr
+	if p, ok := conf.GetString("kumuluzee.discovery.etcd.protocol"); ok {
+		d.protocol = p
 	} else {
-		etcdAddresses = "http://localhost:2379"
+		d.protocol = "http"
 	}
-	if client, err := createEtcdClient(etcdAddresses); err == nil {
-		logger.Info("etcd client addresses set to: %v", etcdAddresses)
-		d.client = client
-	} else {
-		logger.Error("Failed to create etcd client: %s", err.Error())
+
+	clientConf, err := loadEtcdClientConfiguration(conf)
+	if err != nil {
+		logger.Error("Invalid etcd client configuration", errField(err))
+		return nil
+	}
+	c, err := createEtcdClient(clientConf)
+	if err != nil {
+		logger.Error("Failed to create etcd client", errField(err))
+		return nil
+	}
+	logger.Info("etcd client addresses set", F("addresses", clientConf.hosts))
+	d.client = c
+	d.ctx, d.stop = context.WithCancel(context.Background())
+
+	if clientConf.autoSyncInterval > 0 {
+		logger.Debug("etcd endpoint auto-sync interval set", F("interval", clientConf.autoSyncInterval))
+		go d.autoSync(clientConf.autoSyncInterval)
 	}
 
 	d.kvClient = client.NewKeysAPI(*d.client)
@@ -101,54 +141,136 @@ func newEtcdDiscoverySource(options config.Options, logger *logm.Logm) discovery
 
 func (d *etcdDiscoverySource) RegisterService(options RegisterOptions) (serviceID string, err error) {
 	regconf := loadServiceRegisterConfiguration(d.configOptions, options)
-	d.options = &regconf
 
-	d.serviceInstance = &etcdServiceInstance{
+	inst := &etcdServiceInstance{
+		options:   &regconf,
+		addresses: loadServiceAddresses(regconf, options),
 		singleton: options.Singleton,
 	}
+	inst.status = InstanceEnabled
+	inst.weight = regconf.Discovery.Weight
 
 	uuid4, err := uuid.NewV4()
 	if err != nil {
-		d.logger.Error(err.Error())
+		d.logger.Error("Generating instance id failed", errField(err))
 	}
 
-	d.serviceInstance.id = uuid4.String()
+	inst.id = uuid4.String()
 
-	d.serviceInstance.etcdKeyDir = fmt.Sprintf("/environments/%s/services/%s/%s/instances/%s",
-		regconf.Env.Name, regconf.Name, regconf.Version, d.serviceInstance.id)
+	inst.etcdKeyDir = fmt.Sprintf("/environments/%s/services/%s/%s/instances/%s",
+		regconf.Env.Name, regconf.Name, regconf.Version, inst.id)
 
-	go d.run(d.startRetryDelay)
+	d.instancesMutex.Lock()
+	d.serviceInstances = append(d.serviceInstances, inst)
+	d.instancesMutex.Unlock()
 
-	return d.serviceInstance.id, nil
+	go d.run(inst, d.startRetryDelay)
+
+	return inst.id, nil
 }
 
 func (d *etcdDiscoverySource) DeregisterService() error {
-	d.logger.Info("Service deregistration, id=%s", d.serviceInstance.id)
-	_, err := d.kvClient.Delete(context.Background(),
-		d.serviceInstance.etcdKeyDir,
-		&client.DeleteOptions{
-			Recursive: true,
-			Dir:       true,
-		})
-	return err
+	d.stop()
+
+	d.instancesMutex.Lock()
+	instances := d.serviceInstances
+	d.serviceInstances = nil
+	d.instancesMutex.Unlock()
+
+	var lastErr error
+	for _, inst := range instances {
+		d.logger.Info("Service deregistration", serviceField(inst.options.Name), instanceField(inst.id))
+		inst.markDeregistered()
+		reqCtx, req := startBackendRequest(context.Background(), d.tracer, d.metrics, "etcd", "deregister",
+			attrService.String(inst.options.Name), attrInstanceID.String(inst.id))
+		_, err := d.kvClient.Delete(reqCtx,
+			inst.etcdKeyDir,
+			&client.DeleteOptions{
+				Recursive: true,
+				Dir:       true,
+			})
+		req.end(err)
+		if err != nil {
+			d.logger.Error("Service deregistration failed", serviceField(inst.options.Name), instanceField(inst.id), errField(err))
+			lastErr = err
+		}
+		d.metrics.deregistered(inst.options.Name, inst.id)
+	}
+	return lastErr
+}
+
+func (d *etcdDiscoverySource) DiscoverService(ctx context.Context, options DiscoverOptions) (string, error) {
+	fillDefaultDiscoverOptions(&options, d.discoverOptions)
+	requested := options // options are changed by fallback environments
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attrEnvironment.String(options.Environment), attrVersionRange.String(options.Version))
+
+	discoveredInstances, options, err := discoverInEnvironments(ctx, d, options, d.logger)
+	if err != nil {
+		if lastKnown := d.lastKnownServices.get(requested); lastKnown != "" {
+			d.logger.Warn("Service discovery failed, using last known service", serviceField(options.Value), errField(err))
+			d.metrics.staleFallback(options.Value)
+			markStale(ctx)
+			return lastKnown, nil
+		}
+		d.logger.Error("Service discovery failed", serviceField(options.Value), errField(err))
+		return "", err
+	}
+
+	trafficSplit := d.trafficSplitRules(options.Environment, options.Value)
+	service, err := pickRandomServiceInstance(discoveredInstances, d.gatewayURLWatches(), trafficSplit, d.outliers, options, d.lastKnownServices.get(requested))
+
+	if err != nil {
+		if service != "" {
+			d.logger.Warn("Service discovery failed, using last known service", serviceField(options.Value), errField(err))
+			d.metrics.staleFallback(options.Value)
+			markStale(ctx)
+			return service, nil
+		}
+
+		d.logger.Error("Service discovery failed", serviceField(options.Value), errField(err))
+		return "", err
+	}
+
+	span.SetAttributes(attrFallback.Bool(false))
+	d.lastKnownServices.set(requested, service)
+	return service, nil
 }
 
-func (d *etcdDiscoverySource) DiscoverService(options DiscoverOptions) (string, error) {
-	fillDefaultDiscoverOptions(&options)
+// returns instances of all versions of service, given by filled discover options, and creates
+// gateway URL watches for their versions. If discovery fails, cached instances are returned, if a
+// cache snapshot is set.
+func (d *etcdDiscoverySource) discoverInstances(ctx context.Context, options DiscoverOptions) ([]discoveredService, error) {
+	discoveredInstances, err := d.queryInstances(ctx, options)
+	if err != nil {
+		if stale, ok := d.cache.stale(options.Environment, options.Value); ok {
+			d.logger.Warn("Service discovery failed, using cached instances", serviceField(options.Value), errField(err))
+			d.metrics.staleFallback(options.Value)
+			trace.SpanFromContext(ctx).SetAttributes(attrStale.Bool(true))
+			return stale, nil
+		}
+		return nil, err
+	}
+
+	d.metrics.setDiscoveredInstances(options.Value, len(discoveredInstances))
+	d.cache.set(options.Environment, options.Value, discoveredInstances, d.gatewayURLs.snapshot())
+
+	return discoveredInstances, nil
+}
 
+// queries instances of all versions of service and creates gateway URL watches for their versions
+func (d *etcdDiscoverySource) queryInstances(ctx context.Context, options DiscoverOptions) ([]discoveredService, error) {
 	kvPath := fmt.Sprintf("environments/%s/services/%s/", options.Environment, options.Value)
 
-	resp, err := d.kvClient.Get(context.Background(), kvPath, &client.GetOptions{
+	reqCtx, req := startBackendRequest(ctx, d.tracer, d.metrics, "etcd", "discover")
+	resp, err := d.kvClient.Get(reqCtx, kvPath, &client.GetOptions{
 		Recursive: true,
 	})
+	req.end(err)
 
 	if err != nil {
-		if d.lastKnownService != "" {
-			d.logger.Warning("Service discovery failed, using last known service. Error: %s", err.Error())
-			return d.lastKnownService, nil
-		}
-		d.logger.Error("Service discovery failed: %s", err.Error())
-		return "", err
+		return nil, err
 	}
 
 	// ----- extract all services of all versions of given environment and name
@@ -165,107 +287,315 @@ func (d *etcdDiscoverySource) DiscoverService(options DiscoverOptions) (string,
 			}
 		}
 
-		// iterate all instances
-		for _, instance := range instances.Nodes {
-			discoveredInstance := discoveredService{}
-			discoveredInstance.id = path.Base(instance.Key)
+		if instances == nil {
+			// not a version directory (e.g. trafficSplit key) or version without instances
+			continue
+		}
 
-			version, err := semver.ParseTolerant(currentVersion)
-			if err != nil {
-				d.logger.Warning("semver parsing failed for: %s, error: %s", currentVersion, err.Error())
-				break // break out of this version, can't parse it
-			}
-			discoveredInstance.version = version
+		version, err := semver.ParseTolerant(currentVersion)
+		if err != nil {
+			d.logger.Warn("semver parsing failed", serviceField(options.Value), F("version", currentVersion), errField(err))
+			continue // skip this version, can't parse it
+		}
 
-			for _, node := range instance.Nodes {
-				// fmt.Printf("key=%v value=%v", node.Key, node.Value)
-				if path.Base(node.Key) == "url" {
-					discoveredInstance.directURL = node.Value
-				}
-			}
+		// iterate all instances
+		for _, instance := range instances.Nodes {
+			discoveredInstance := etcdDiscoveredInstance(instance, version)
 
 			discoveredInstances = append(discoveredInstances, discoveredInstance)
 
 			// ---- add a watch for gatewayUrl for discovering service (if not already made)
-			// TODO: this part is the same for both etcd & consul: make the code more DRY
-			watcherNamespace := fmt.Sprintf("/environments/%s/services/%s/%s", options.Environment, options.Value, discoveredInstance.version.String())
-
-			util := config.NewUtil(config.Options{
-				Extension:          d.configOptions.Extension,
-				ExtensionNamespace: watcherNamespace,
-				ConfigPath:         d.configOptions.ConfigPath,
-				LogLevel:           logm.LvlMute,
-			})
+			watcherNamespace := serviceVersionNamespace(options.Environment, options.Value, discoveredInstance.version.String())
+			d.gatewayURLs.watch(d.watchKey, watcherNamespace, d.logger, d.metrics)
+			// ----
+		}
+	}
+	// -----
 
-			var hasWatch bool
-			for _, w := range d.gatewayURLs {
-				if w.gatewayID == watcherNamespace {
-					// watch already set :)
-					hasWatch = true
-					break
-				}
+	return discoveredInstances, nil
+}
+
+func (d *etcdDiscoverySource) gatewayURLWatches() []*gatewayURLWatch {
+	// cached gateway URLs are only used for versions without a watch
+	watches := d.gatewayURLs.snapshot()
+	return append(watches, d.cache.staleGatewayURLs()...)
+}
+
+func (d *etcdDiscoverySource) trafficSplitRules(environment, service string) []TrafficSplitRule {
+	return d.trafficSplits.rules(d.watchKey, environment, service, d.logger)
+}
+
+// weight is stored in instance's weight key
+func (d *etcdDiscoverySource) SetInstanceWeight(serviceID string, weight int) error {
+	var etcdKeyDir string
+	if inst := d.findInstance(serviceID); inst != nil {
+		inst.setWeight(weight)
+		etcdKeyDir = inst.etcdKeyDir
+	} else {
+		var err error
+		if etcdKeyDir, err = d.findInstanceKeyDir(serviceID); err != nil {
+			return err
+		}
+	}
+
+	d.logger.Info("Setting instance weight", instanceField(serviceID), F("key", etcdKeyDir), F("weight", weight))
+	_, err := d.kvClient.Set(context.Background(), etcdKeyDir+"/"+weightKey, strconv.Itoa(weight), nil)
+	return err
+}
+
+func (d *etcdDiscoverySource) RegisteredServiceIDs() []string {
+	d.instancesMutex.Lock()
+	defer d.instancesMutex.Unlock()
+	var ids []string
+	for _, inst := range d.serviceInstances {
+		ids = append(ids, inst.id)
+	}
+	return ids
+}
+
+// status is stored in instance's status key, enabled instances have no status key
+func (d *etcdDiscoverySource) SetInstanceStatus(serviceID string, status InstanceStatus) error {
+	var etcdKeyDir string
+	if inst := d.findInstance(serviceID); inst != nil {
+		inst.setStatus(status)
+		etcdKeyDir = inst.etcdKeyDir
+	} else {
+		var err error
+		if etcdKeyDir, err = d.findInstanceKeyDir(serviceID); err != nil {
+			return err
+		}
+	}
+	return d.applyInstanceStatus(etcdKeyDir, status)
+}
+
+func (d *etcdDiscoverySource) SetKey(key, value string) error {
+	_, err := d.kvClient.Set(context.Background(), key, value, nil)
+	return err
+}
+
+// deleting a missing key succeeds, as with Consul
+func (d *etcdDiscoverySource) DeleteKey(key string) error {
+	_, err := d.kvClient.Delete(context.Background(), key, nil)
+	if client.IsKeyNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *etcdDiscoverySource) ListGatewayURLs(environment string) ([]GatewayURL, error) {
+	resp, err := d.kvClient.Get(context.Background(), path.Join("/environments", environment), &client.GetOptions{
+		Recursive: true,
+	})
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	var walk func(node *client.Node)
+	walk = func(node *client.Node) {
+		if !node.Dir {
+			values[node.Key] = node.Value
+		}
+		for _, n := range node.Nodes {
+			walk(n)
+		}
+	}
+	walk(resp.Node)
+
+	return gatewayURLsOf(values), nil
+}
+
+// keys are laid out as /environments/<environment>/services/<service>/<version>/instances/<id>/...
+func (d *etcdDiscoverySource) ListInstances(environment, service string) ([]Instance, error) {
+	resp, err := d.kvClient.Get(context.Background(), path.Join("/environments", environment), &client.GetOptions{
+		Recursive: true,
+		Sort:      true,
+	})
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	envNodes := resp.Node.Nodes
+	if environment != "" {
+		envNodes = []*client.Node{resp.Node}
+	}
+
+	var instances []Instance
+	for _, envNode := range envNodes {
+		for _, servicesNode := range envNode.Nodes {
+			if path.Base(servicesNode.Key) != "services" {
+				continue
 			}
-			if !hasWatch {
-				// make a watch for this one!
-				d.logger.Info("Creating a gatewayUrl watch for %s", watcherNamespace)
-
-				g, _ := util.GetString("gatewayUrl")
-				d.gatewayURLs = append(d.gatewayURLs, &gatewayURLWatch{
-					gatewayID:  watcherNamespace,
-					gatewayURL: g,
-				})
-				util.Subscribe("gatewayUrl", func(key string, value string) {
-					for _, w := range d.gatewayURLs {
-						if w.gatewayID == watcherNamespace {
-							d.logger.Info("Updated gatewayUrl value for %s (new value: %s)", watcherNamespace, value)
-							w.gatewayURL = value
-							break
+			for _, serviceNode := range servicesNode.Nodes {
+				if service != "" && path.Base(serviceNode.Key) != service {
+					continue
+				}
+				for _, versionNode := range serviceNode.Nodes {
+					version, err := semver.ParseTolerant(path.Base(versionNode.Key))
+					if err != nil {
+						continue // not a version directory (e.g. trafficSplit key)
+					}
+					for _, n := range versionNode.Nodes {
+						if path.Base(n.Key) != "instances" {
+							continue
+						}
+						for _, instanceNode := range n.Nodes {
+							discoveredInstance := etcdDiscoveredInstance(instanceNode, version)
+							instances = append(instances,
+								discoveredInstance.instance(path.Base(envNode.Key), path.Base(serviceNode.Key)))
 						}
 					}
-					return
-				})
+				}
 			}
-			// ----
 		}
 	}
-	// -----
+	return instances, nil
+}
 
-	service, err := pickRandomServiceInstance(discoveredInstances, d.gatewayURLs, options, d.lastKnownService)
+// static instance keys are set without TTL, unless TTL is set on the instance directory
+func (d *etcdDiscoverySource) RegisterStaticInstance(instance StaticInstance) (string, error) {
+	if instance.ID == "" {
+		uuid4, err := uuid.NewV4()
+		if err != nil {
+			return "", err
+		}
+		instance.ID = uuid4.String()
+	}
 
-	if err != nil {
-		if service != "" {
-			d.logger.Warning("Service discovery failed, using last known service. Error: %s", err.Error())
-			return d.lastKnownService, nil
+	etcdKeyDir := staticInstanceKeyDir(instance)
+	if instance.TTL > 0 {
+		// update TTL of existing directory, or create it
+		_, err := d.kvClient.Set(context.Background(), etcdKeyDir, "", &client.SetOptions{
+			TTL:       instance.TTL,
+			Dir:       true,
+			PrevExist: client.PrevExist,
+		})
+		if client.IsKeyNotFound(err) {
+			_, err = d.kvClient.Set(context.Background(), etcdKeyDir, "", &client.SetOptions{
+				TTL: instance.TTL,
+				Dir: true,
+			})
+		}
+		if err != nil {
+			return "", err
 		}
+	}
 
-		d.logger.Error("Service discovery failed: %s", err.Error())
-		return "", err
+	keys := map[string]string{
+		"url":     instance.URL,
+		weightKey: strconv.Itoa(instance.Weight),
+	}
+	for name, addr := range instance.Addresses {
+		keys[addressKey(name)] = addr
+	}
+	if instance.Zone != "" {
+		keys[zoneKey] = instance.Zone
+	}
+	if instance.Region != "" {
+		keys[regionKey] = instance.Region
+	}
+	if instance.MirroredFrom != "" {
+		keys[mirroredFromKey] = instance.MirroredFrom
 	}
 
-	d.lastKnownService = service
-	return service, nil
+	for key, value := range keys {
+		if _, err := d.kvClient.Set(context.Background(), etcdKeyDir+"/"+key, value, nil); err != nil {
+			return "", err
+		}
+	}
+	return instance.ID, nil
+}
+
+// directory is refreshed without notifying watchers, like TTL updates of registered instances
+func (d *etcdDiscoverySource) refreshStaticInstance(instance StaticInstance) error {
+	_, err := d.kvClient.Set(context.Background(), staticInstanceKeyDir(instance), "", &client.SetOptions{
+		TTL:       instance.TTL,
+		Dir:       true,
+		PrevExist: client.PrevExist,
+		Refresh:   true,
+	})
+	return err
+}
+
+// instances of this process stop updating TTL
+func (d *etcdDiscoverySource) DeregisterInstance(environment, service, instanceID string) error {
+	var etcdKeyDir string
+	if inst := d.removeInstance(instanceID); inst != nil {
+		inst.markDeregistered()
+		d.metrics.deregistered(inst.options.Name, inst.id)
+		etcdKeyDir = inst.etcdKeyDir
+	} else {
+		var err error
+		if etcdKeyDir, err = d.findInstanceKeyDir(instanceID); err != nil {
+			return err
+		}
+	}
+	_, err := d.kvClient.Delete(context.Background(), etcdKeyDir, &client.DeleteOptions{
+		Recursive: true,
+		Dir:       true,
+	})
+	return err
+}
+
+func (d *etcdDiscoverySource) adminState() sourceState {
+	d.instancesMutex.Lock()
+	registrations := []Registration{}
+	for _, inst := range d.serviceInstances {
+		registrations = append(registrations, Registration{
+			ID:          inst.id,
+			ServiceID:   inst.id,
+			Backend:     "etcd",
+			Environment: inst.options.Env.Name,
+			Service:     inst.options.Name,
+			Version:     inst.options.Version,
+			Registered:  inst.isRegistered(),
+			Status:      inst.getStatus(),
+			Weight:      inst.getWeight(),
+		})
+	}
+	d.instancesMutex.Unlock()
+
+	return sourceState{
+		Backend:           "etcd",
+		Registrations:     registrations,
+		Cache:             d.cache.all(),
+		GatewayURLWatches: gatewayURLWatchStates(d.gatewayURLs.snapshot()),
+		LastKnownServices: d.lastKnownServices.all(),
+	}
 }
 
 // functions that aren't discoverySource methods
 
 // if service is not registered, performs registration. Otherwise perform ttl update
-func (d *etcdDiscoverySource) run(retryDelay int64) {
+func (d *etcdDiscoverySource) run(inst *etcdServiceInstance, retryDelay int64) {
+	if inst.isDeregistered() {
+		return
+	}
 
 	var ok bool
-	if !d.serviceInstance.isRegistered {
-		ok = d.register(retryDelay)
+	if !inst.isRegistered() {
+		ok = d.register(inst, retryDelay)
 		if ok {
-			d.serviceInstance.isRegistered = true
+			inst.setRegistered(true)
 		}
 	} else {
-		ok = d.ttlUpdate(retryDelay)
+		ok = d.ttlUpdate(inst, retryDelay)
 		if !ok {
-			d.serviceInstance.isRegistered = false
+			inst.setRegistered(false)
+			d.metrics.heartbeatFailed(inst.options.Name, inst.id)
 		}
 	}
+	d.metrics.setRegistered(inst.options.Name, inst.id, inst.isRegistered())
 
 	if !ok {
 		// Something went wrong with either registration or TTL update :(
+		d.metrics.setRetryDelay(inst.options.Name, inst.id, retryDelay)
 
 		// sleep for current delay
 		time.Sleep(time.Duration(retryDelay) * time.Millisecond)
@@ -274,89 +604,209 @@ func (d *etcdDiscoverySource) run(retryDelay int64) {
 		if newRetryDelay > d.maxRetryDelay {
 			newRetryDelay = d.maxRetryDelay
 		}
-		d.run(newRetryDelay)
+		d.run(inst, newRetryDelay)
 	} else {
 		// Everything is alright, either registration or TTL update was successful :)
+		d.metrics.setRetryDelay(inst.options.Name, inst.id, 0)
 
-		time.Sleep(time.Duration(d.options.Discovery.PingInterval) * time.Second)
-		d.run(d.startRetryDelay)
+		time.Sleep(time.Duration(inst.options.Discovery.PingInterval) * time.Second)
+		d.run(inst, d.startRetryDelay)
 	}
 
 }
 
-func (d *etcdDiscoverySource) register(retryDelay int64) bool {
-	inst := d.serviceInstance
-
-	if d.isServiceRegistered() && inst.singleton {
-		d.logger.Error("Service of this kind is already registered, not registering with options.singleton set to true")
+func (d *etcdDiscoverySource) register(inst *etcdServiceInstance, retryDelay int64) bool {
+	if d.isServiceRegistered(inst) && inst.singleton {
+		d.logger.Error("Service of this kind is already registered, not registering with options.singleton set to true",
+			serviceField(inst.options.Name), instanceField(inst.id))
 		return false
 	}
 
-	d.logger.Info("Registering service: id=%s address=%s port=%d", inst.id, d.options.Server.HTTP.Address, d.options.Server.HTTP.Port)
-
-	d.serviceInstance.serviceURL = d.options.Server.BaseURL
-	if d.serviceInstance.serviceURL == "" {
-		// TODO: if base-url not defined, assume URL from system network interface?
-		d.logger.Error("No base-url provided! Please provide base-url by setting a key kumuluzee.server.base-url in your configuration!")
+	inst.serviceURL = inst.options.Server.BaseURL
+	if inst.serviceURL == "" {
+		address, err := resolveAdvertiseAddress(inst.options)
+		if err != nil {
+			d.logger.Error("No base-url provided and advertise address detection failed. Please provide base-url by setting a key kumuluzee.server.base-url in your configuration!",
+				serviceField(inst.options.Name), instanceField(inst.id), errField(err))
+			return false
+		}
+		inst.serviceURL = advertiseURL(d.protocol, address, inst.options.Server.HTTP.Port)
 	}
 
+	d.logger.Info("Registering service", serviceField(inst.options.Name), instanceField(inst.id), F("url", inst.serviceURL))
+
 	// set TTL on instance directory
-	_, err := d.kvClient.Set(context.Background(),
-		d.serviceInstance.etcdKeyDir,
+	reqCtx, req := startBackendRequest(context.Background(), d.tracer, d.metrics, "etcd", "register",
+		attrService.String(inst.options.Name), attrInstanceID.String(inst.id))
+	_, err := d.kvClient.Set(reqCtx,
+		inst.etcdKeyDir,
 		"",
 		&client.SetOptions{
-			TTL: time.Duration(d.options.Discovery.TTL) * time.Second,
+			TTL: time.Duration(inst.options.Discovery.TTL) * time.Second,
 			Dir: true,
 		})
+	req.end(err)
 	if err != nil {
-		d.logger.Error(fmt.Sprintf("Service registration failed: %s", err.Error()))
+		d.logger.Error("Service registration failed", serviceField(inst.options.Name), instanceField(inst.id), errField(err))
 		return false
 	}
 
 	_, err = d.kvClient.Set(context.Background(),
-		d.serviceInstance.etcdKeyDir+"/url",
-		d.serviceInstance.serviceURL,
+		inst.etcdKeyDir+"/url",
+		inst.serviceURL,
 		nil)
 	if err != nil {
-		d.logger.Error(fmt.Sprintf("Service registration failed: %s", err.Error()))
+		d.logger.Error("Service registration failed", serviceField(inst.options.Name), instanceField(inst.id), errField(err))
 		return false
 	}
 
-	d.logger.Info("Service registered, id=%s", inst.id)
+	for name, url := range inst.addresses {
+		_, err = d.kvClient.Set(context.Background(),
+			inst.etcdKeyDir+"/"+addressKey(name),
+			url,
+			nil)
+		if err != nil {
+			d.logger.Error("Service registration failed", serviceField(inst.options.Name), instanceField(inst.id), errField(err))
+			return false
+		}
+	}
+
+	_, err = d.kvClient.Set(context.Background(),
+		inst.etcdKeyDir+"/"+weightKey,
+		strconv.Itoa(inst.getWeight()),
+		nil)
+	if err != nil {
+		d.logger.Error("Service registration failed", serviceField(inst.options.Name), instanceField(inst.id), errField(err))
+		return false
+	}
+
+	locality := map[string]string{
+		zoneKey:   inst.options.Discovery.Zone,
+		regionKey: inst.options.Discovery.Region,
+	}
+	for key, value := range locality {
+		if value == "" {
+			continue
+		}
+		_, err = d.kvClient.Set(context.Background(), inst.etcdKeyDir+"/"+key, value, nil)
+		if err != nil {
+			d.logger.Error("Service registration failed", serviceField(inst.options.Name), instanceField(inst.id), errField(err))
+			return false
+		}
+	}
+
+	// re-registered instance has to get its status back
+	if status := inst.getStatus(); !status.isEnabled() {
+		if err := d.applyInstanceStatus(inst.etcdKeyDir, status); err != nil {
+			d.logger.Error("Service registration failed", serviceField(inst.options.Name), instanceField(inst.id), errField(err))
+			return false
+		}
+	}
+
+	d.logger.Info("Service registered", serviceField(inst.options.Name), instanceField(inst.id))
 	return true
 }
 
-func (d *etcdDiscoverySource) ttlUpdate(retryDelay int64) bool {
-	inst := d.serviceInstance
-	// d.logger.Verbose("Updating TTL for service %s", inst.id)
-
-	_, err := d.kvClient.Set(context.Background(), inst.etcdKeyDir, "", &client.SetOptions{
-		TTL:       time.Duration(d.options.Discovery.TTL) * time.Second,
+func (d *etcdDiscoverySource) ttlUpdate(inst *etcdServiceInstance, retryDelay int64) bool {
+	reqCtx, req := startBackendRequest(context.Background(), d.tracer, d.metrics, "etcd", "ttl-update",
+		attrService.String(inst.options.Name), attrInstanceID.String(inst.id))
+	_, err := d.kvClient.Set(reqCtx, inst.etcdKeyDir, "", &client.SetOptions{
+		TTL:       time.Duration(inst.options.Discovery.TTL) * time.Second,
 		Dir:       true,
 		PrevExist: client.PrevExist,
 		Refresh:   true,
 	})
+	req.end(err)
 
 	if err != nil {
-		d.logger.Error("TTL update failed, error: %s, retry delay: %d ms", inst.id, err.Error(), retryDelay)
+		d.logger.Error("TTL update failed", serviceField(inst.options.Name), instanceField(inst.id), errField(err), F("retry_delay_ms", retryDelay))
 		return false
 	}
 
-	d.logger.Verbose("TTL update for service %s", inst.id)
+	d.logger.Debug("TTL update", serviceField(inst.options.Name), instanceField(inst.id))
 	return true
 }
 
+// periodically refreshes the list of etcd endpoints from cluster membership, until the source is
+// stopped
+func (d *etcdDiscoverySource) autoSync(interval time.Duration) {
+	for {
+		// returns only on a failed sync or when the source is stopped
+		err := (*d.client).AutoSync(d.ctx, interval)
+		if d.ctx.Err() != nil {
+			return
+		}
+		d.logger.Warn("etcd endpoint auto-sync failed", errField(err))
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// keyWatcher which reads keys through the etcd client, so the same endpoints, credentials and TLS
+// configuration are used as for discovery. Watching stops when the source is stopped.
+func (d *etcdDiscoverySource) watchKey(namespace, key string, onChange func(value string)) {
+	key = namespace + "/" + key
+	value, index := d.getKey(key)
+	onChange(value)
+
+	go func() {
+		watcher := d.kvClient.Watcher(key, &client.WatcherOptions{AfterIndex: index})
+		for {
+			resp, err := watcher.Next(d.ctx)
+			if d.ctx.Err() != nil {
+				return
+			}
+			var newValue string
+			if err != nil {
+				d.logger.Warn("Watching etcd key failed", F("key", key), errField(err), F("retry_delay_ms", d.startRetryDelay))
+				select {
+				case <-d.ctx.Done():
+					return
+				case <-time.After(time.Duration(d.startRetryDelay) * time.Millisecond):
+				}
+				// changes may have been missed, read the key again and watch from there
+				newValue, index = d.getKey(key)
+				watcher = d.kvClient.Watcher(key, &client.WatcherOptions{AfterIndex: index})
+			} else if resp.Node != nil {
+				// deleted and expired keys have no value
+				newValue = resp.Node.Value
+			}
+			if newValue != value {
+				value = newValue
+				onChange(value)
+			}
+		}
+	}()
+}
+
+// returns value of key (empty if missing) and etcd index to watch its changes from
+func (d *etcdDiscoverySource) getKey(key string) (string, uint64) {
+	resp, err := d.kvClient.Get(context.Background(), key, nil)
+	if err != nil {
+		if cErr, ok := err.(client.Error); ok && cErr.Code == client.ErrorCodeKeyNotFound {
+			return "", cErr.Index
+		}
+		d.logger.Warn("Reading etcd key failed", F("key", key), errField(err))
+		return "", 0
+	}
+	return resp.Node.Value, resp.Index
+}
+
 // returns true if there are any services of this kind (env+name) registered
-func (d *etcdDiscoverySource) isServiceRegistered() bool {
+func (d *etcdDiscoverySource) isServiceRegistered(inst *etcdServiceInstance) bool {
 	etcdKeyDir := fmt.Sprintf("/environments/%s/services/%s/%s/instances/",
-		d.options.Env.Name, d.options.Name, d.options.Version)
+		inst.options.Env.Name, inst.options.Name, inst.options.Version)
 
 	resp, err := d.kvClient.Get(context.Background(), etcdKeyDir, &client.GetOptions{
 		Recursive: true,
 	})
 
 	if err != nil {
-		d.logger.Warning("isServiceRegistered() failed: %s", err.Error())
+		d.logger.Warn("isServiceRegistered() failed", serviceField(inst.options.Name), instanceField(inst.id), errField(err))
 		return false
 	}
 
@@ -369,9 +819,7 @@ func (d *etcdDiscoverySource) isServiceRegistered() bool {
 				URL = node.Value
 			}
 			if path.Base(node.Key) == "status" {
-				if node.Value == "disabled" {
-					isActive = false
-				}
+				isActive = InstanceStatus(node.Value).isEnabled()
 			}
 		}
 
@@ -383,11 +831,151 @@ func (d *etcdDiscoverySource) isServiceRegistered() bool {
 	return false
 }
 
+// removes instance with given id from instances registered by this source and returns it, or nil
+func (d *etcdDiscoverySource) removeInstance(serviceID string) *etcdServiceInstance {
+	d.instancesMutex.Lock()
+	defer d.instancesMutex.Unlock()
+	for i, inst := range d.serviceInstances {
+		if inst.id == serviceID {
+			d.serviceInstances = append(d.serviceInstances[:i], d.serviceInstances[i+1:]...)
+			return inst
+		}
+	}
+	return nil
+}
+
+// returns instance registered by this source with given id, or nil
+func (d *etcdDiscoverySource) findInstance(serviceID string) *etcdServiceInstance {
+	d.instancesMutex.Lock()
+	defer d.instancesMutex.Unlock()
+	for _, inst := range d.serviceInstances {
+		if inst.id == serviceID {
+			return inst
+		}
+	}
+	return nil
+}
+
+// searches all environments for the key directory of instance with given id
+func (d *etcdDiscoverySource) findInstanceKeyDir(serviceID string) (string, error) {
+	resp, err := d.kvClient.Get(context.Background(), "/environments", &client.GetOptions{
+		Recursive: true,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var keyDir string
+	var walk func(node *client.Node)
+	walk = func(node *client.Node) {
+		if node.Dir && path.Base(node.Key) == serviceID && path.Base(path.Dir(node.Key)) == "instances" {
+			keyDir = node.Key
+			return
+		}
+		for _, n := range node.Nodes {
+			walk(n)
+		}
+	}
+	walk(resp.Node)
+
+	if keyDir == "" {
+		return "", fmt.Errorf("instance with id %s not found", serviceID)
+	}
+	return keyDir, nil
+}
+
+func (d *etcdDiscoverySource) applyInstanceStatus(etcdKeyDir string, status InstanceStatus) error {
+	d.logger.Info("Setting instance status", F("key", etcdKeyDir), F("status", status))
+	if status.isEnabled() {
+		_, err := d.kvClient.Delete(context.Background(), etcdKeyDir+"/status", nil)
+		if client.IsKeyNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	_, err := d.kvClient.Set(context.Background(), etcdKeyDir+"/status", string(status), nil)
+	return err
+}
+
 // functions that aren't discoverySource methods or etcdDiscoverySource methods
 
-func createEtcdClient(addresses string) (*client.Client, error) {
+// etcd client configuration, loaded from kumuluzee.discovery.etcd.* keys
+type etcdClientConfiguration struct {
+	hosts string
+
+	username string
+	password string
+
+	// CA bundle, client certificate and client key: either PEM contents or paths to PEM files
+	ca   string
+	cert string
+	key  string
+
+	dialTimeout      time.Duration
+	requestTimeout   time.Duration
+	autoSyncInterval time.Duration
+}
+
+func loadEtcdClientConfiguration(conf config.Util) (clientConf etcdClientConfiguration, err error) {
+	// Load default values
+	clientConf.hosts = "http://localhost:2379"
+	clientConf.dialTimeout = 30 * time.Second
+	clientConf.requestTimeout = client.DefaultRequestTimeout
+
+	if addr, ok := conf.GetString("kumuluzee.discovery.etcd.hosts"); ok {
+		clientConf.hosts = addr
+	}
+	if u, ok := conf.GetString("kumuluzee.discovery.etcd.username"); ok {
+		clientConf.username = u
+	}
+	if p, ok := conf.GetString("kumuluzee.discovery.etcd.password"); ok {
+		clientConf.password = p
+	}
+	if ca, ok := conf.GetString("kumuluzee.discovery.etcd.ca"); ok {
+		clientConf.ca = ca
+	}
+	if cert, ok := conf.GetString("kumuluzee.discovery.etcd.cert"); ok {
+		clientConf.cert = cert
+	}
+	if key, ok := conf.GetString("kumuluzee.discovery.etcd.key"); ok {
+		clientConf.key = key
+	}
+	if t, ok := conf.GetInt("kumuluzee.discovery.etcd.dial-timeout-ms"); ok {
+		clientConf.dialTimeout = time.Duration(t) * time.Millisecond
+	}
+	if t, ok := conf.GetInt("kumuluzee.discovery.etcd.request-timeout-ms"); ok {
+		clientConf.requestTimeout = time.Duration(t) * time.Millisecond
+	}
+	if t, ok := conf.GetInt("kumuluzee.discovery.etcd.auto-sync-interval-ms"); ok {
+		clientConf.autoSyncInterval = time.Duration(t) * time.Millisecond
+	}
+
+	if (clientConf.cert == "") != (clientConf.key == "") {
+		return clientConf, fmt.Errorf("kumuluzee.discovery.etcd.cert and kumuluzee.discovery.etcd.key must be set together")
+	}
+	return clientConf, nil
+}
+
+func createEtcdClient(clientConf etcdClientConfiguration) (*client.Client, error) {
+	tlsConfig, err := createEtcdTLSConfig(clientConf)
+	if err != nil {
+		return nil, err
+	}
+
 	clientConfig := client.Config{
-		Endpoints: strings.Split(addresses, ","),
+		Endpoints: strings.Split(clientConf.hosts, ","),
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: (&net.Dialer{
+				Timeout:   clientConf.dialTimeout,
+				KeepAlive: 30 * time.Second,
+			}).Dial,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     tlsConfig,
+		},
+		Username:                clientConf.username,
+		Password:                clientConf.password,
+		HeaderTimeoutPerRequest: clientConf.requestTimeout,
 	}
 
 	client, err := client.New(clientConfig)
@@ -396,3 +984,88 @@ func createEtcdClient(addresses string) (*client.Client, error) {
 	}
 	return &client, nil
 }
+
+// returns nil if neither CA bundle nor client certificate is configured
+func createEtcdTLSConfig(clientConf etcdClientConfiguration) (*tls.Config, error) {
+	if clientConf.ca == "" && clientConf.cert == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if clientConf.ca != "" {
+		ca, err := readPEM(clientConf.ca)
+		if err != nil {
+			return nil, fmt.Errorf("reading etcd CA bundle failed: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("etcd CA bundle contains no valid certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if clientConf.cert != "" {
+		cert, err := readPEM(clientConf.cert)
+		if err != nil {
+			return nil, fmt.Errorf("reading etcd client certificate failed: %s", err.Error())
+		}
+		key, err := readPEM(clientConf.key)
+		if err != nil {
+			return nil, fmt.Errorf("reading etcd client key failed: %s", err.Error())
+		}
+		keyPair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("etcd client certificate is invalid: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{keyPair}
+	}
+
+	return tlsConfig, nil
+}
+
+// value is either PEM encoded contents or a path to a PEM file
+func readPEM(value string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+// extracts instance from instance directory node
+func etcdDiscoveredInstance(instance *client.Node, version semver.Version) discoveredService {
+	discoveredInstance := discoveredService{}
+	discoveredInstance.id = path.Base(instance.Key)
+	discoveredInstance.weight = 1
+	discoveredInstance.version = version
+
+	for _, node := range instance.Nodes {
+		if path.Base(node.Key) == "url" {
+			discoveredInstance.directURL = node.Value
+		} else if path.Base(node.Key) == "status" {
+			discoveredInstance.status = InstanceStatus(node.Value)
+		} else if path.Base(node.Key) == weightKey {
+			if w, err := strconv.Atoi(node.Value); err == nil {
+				discoveredInstance.weight = w
+			}
+		} else if path.Base(node.Key) == zoneKey {
+			discoveredInstance.zone = node.Value
+		} else if path.Base(node.Key) == regionKey {
+			discoveredInstance.region = node.Value
+		} else if path.Base(node.Key) == mirroredFromKey {
+			discoveredInstance.mirroredFrom = node.Value
+		} else if name, ok := addressName(path.Base(node.Key)); ok {
+			if discoveredInstance.addresses == nil {
+				discoveredInstance.addresses = make(map[string]string)
+			}
+			discoveredInstance.addresses[name] = node.Value
+		}
+	}
+	return discoveredInstance
+}
+
+// returns etcd key directory of a static instance
+func staticInstanceKeyDir(instance StaticInstance) string {
+	return fmt.Sprintf("/environments/%s/services/%s/%s/instances/%s",
+		instance.Environment, instance.Service, instance.Version, instance.ID)
+}
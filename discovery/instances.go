@@ -0,0 +1,155 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/blang/semver"
+)
+
+// Instance is a service instance in the registry, as listed by Util.ListInstances.
+type Instance struct {
+	Environment string `json:"environment"`
+	Service     string `json:"service"`
+	Version     string `json:"version"`
+	ID          string `json:"id"`
+	// URL is the direct URL of the instance.
+	URL string `json:"url"`
+	// Addresses are additional named URLs of the instance, keyed by access type.
+	Addresses map[string]string `json:"addresses,omitempty"`
+	Status    InstanceStatus    `json:"status"`
+	// Healthy is false if health check of the instance is failing. Only Consul instances can be
+	// unhealthy, etcd instances are removed when their TTL expires.
+	Healthy bool   `json:"healthy"`
+	Weight  int    `json:"weight"`
+	Zone    string `json:"zone,omitempty"`
+	Region  string `json:"region,omitempty"`
+	// MirroredFrom is the backend (e.g. "etcd") the instance is copied from by Mirror, or empty.
+	MirroredFrom string `json:"mirroredFrom,omitempty"`
+	// Datacenter is the Consul datacenter of the instance.
+	Datacenter string `json:"datacenter,omitempty"`
+}
+
+// StaticInstance is a service instance registered by Util.RegisterStaticInstance. Unless TTL is
+// set, static instances stay registered until deregistered with Util.DeregisterInstance. They can
+// be used for services that can't register themselves, e.g. external services.
+type StaticInstance struct {
+	Environment string
+	Service     string
+	Version     string
+	// ID of the instance. If empty, a random id is generated.
+	ID string
+	// URL is the direct URL of the instance, e.g. "http://10.0.0.5:8080".
+	URL string
+	// Addresses are additional named URLs of the instance, keyed by access type.
+	Addresses map[string]string
+	// Weight of the instance, default value is 1.
+	Weight int
+	Zone   string
+	Region string
+	// MirroredFrom is set by Mirror to the backend the instance is copied from.
+	MirroredFrom string
+	// TTL of the instance. If set, the instance is removed (etcd) or marked as failing (Consul)
+	// unless it is registered again within TTL. Mirror sets it, so that mirrored instances expire
+	// if the mirror stops.
+	TTL time.Duration
+}
+
+// ListInstances returns instances of a service in given environment. If service is an empty
+// string, instances of all services are returned, and if environment is an empty string, instances
+// of all environments are returned.
+func (d Util) ListInstances(environment, service string) ([]Instance, error) {
+	return d.discoverySource.ListInstances(environment, service)
+}
+
+// RegisterStaticInstance registers a static instance and returns its id. With multiple backends,
+// the instance is registered in each of them, and the id is returned if registration succeeded in
+// any backend, together with an error joining failures of the other backends.
+func (d Util) RegisterStaticInstance(instance StaticInstance) (string, error) {
+	if instance.Environment == "" || instance.Service == "" || instance.Version == "" {
+		return "", fmt.Errorf("environment, service and version of a static instance are required")
+	}
+	u, err := url.Parse(instance.URL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("invalid static instance url: %s", instance.URL)
+	}
+	if instance.Weight == 0 {
+		instance.Weight = 1
+	} else if instance.Weight < 0 {
+		return "", fmt.Errorf("weight must not be negative, got %d", instance.Weight)
+	}
+	d.Logger.Info("Registering static instance", serviceField(instance.Service), instanceField(instance.ID), F("url", instance.URL))
+	return d.discoverySource.RegisterStaticInstance(instance)
+}
+
+// DeregisterInstance removes an instance with given id from the registry. It can be used for
+// static instances and for instances of other processes (which register again with their next TTL
+// update, unless they are shut down). Instances registered by this Util stop updating their TTL.
+func (d Util) DeregisterInstance(environment, service, instanceID string) error {
+	d.Logger.Info("Deregistering instance", serviceField(service), instanceField(instanceID))
+	return d.discoverySource.DeregisterInstance(environment, service, instanceID)
+}
+
+func (s discoveredService) instance(environment, service string) Instance {
+	status := s.status
+	if status == "" {
+		status = InstanceEnabled
+	}
+	return Instance{
+		Environment:  environment,
+		Service:      service,
+		Version:      s.version.String(),
+		ID:           s.id,
+		URL:          s.directURL,
+		Addresses:    s.addresses,
+		Status:       status,
+		Healthy:      true,
+		Weight:       s.weight,
+		Zone:         s.zone,
+		Region:       s.region,
+		MirroredFrom: s.mirroredFrom,
+		Datacenter:   s.datacenter,
+	}
+}
+
+// converts instance back to a discovered service, returns false if its version can't be parsed
+func (i Instance) discoveredService() (discoveredService, bool) {
+	version, err := semver.ParseTolerant(i.Version)
+	if err != nil {
+		return discoveredService{}, false
+	}
+	return discoveredService{
+		version:      version,
+		id:           i.ID,
+		directURL:    i.URL,
+		addresses:    i.Addresses,
+		status:       i.Status,
+		weight:       i.Weight,
+		zone:         i.Zone,
+		region:       i.Region,
+		mirroredFrom: i.MirroredFrom,
+		datacenter:   i.Datacenter,
+	}, true
+}
@@ -0,0 +1,146 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mc0239/logm"
+)
+
+// Logger is used by Util and discovery sources for logging. Messages are constant strings, while
+// variable data is passed as structured fields.
+// Adapters for log/slog, zap and zerolog are in packages slogadapter, zapadapter and
+// zerologadapter. By default, logm is used, see NewLogmLogger.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+// Field is a key-value pair, attached to a log message.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Keys of fields, attached to log messages by this package.
+const (
+	FieldService    = "service"
+	FieldInstanceID = "instance_id"
+	FieldBackend    = "backend"
+	FieldError      = "error"
+)
+
+// F creates a new field.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+func serviceField(name string) Field {
+	return F(FieldService, name)
+}
+
+func instanceField(id string) Field {
+	return F(FieldInstanceID, id)
+}
+
+func errField(err error) Field {
+	return F(FieldError, err)
+}
+
+// NewLogmLogger returns a Logger that writes to given logm logger. Fields are appended to the
+// message as key=value pairs.
+func NewLogmLogger(l *logm.Logm) Logger {
+	return logmLogger{l}
+}
+
+type logmLogger struct {
+	l *logm.Logm
+}
+
+func (l logmLogger) Debug(msg string, fields ...Field) {
+	l.l.Verbose("%s", formatFields(msg, fields))
+}
+
+func (l logmLogger) Info(msg string, fields ...Field) {
+	l.l.Info("%s", formatFields(msg, fields))
+}
+
+func (l logmLogger) Warn(msg string, fields ...Field) {
+	l.l.Warning("%s", formatFields(msg, fields))
+}
+
+func (l logmLogger) Error(msg string, fields ...Field) {
+	l.l.Error("%s", formatFields(msg, fields))
+}
+
+// formats message with fields as: message, key=value key2=value2
+func formatFields(msg string, fields []Field) string {
+	if len(fields) == 0 {
+		return msg
+	}
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for i, f := range fields {
+		if i == 0 {
+			sb.WriteString(", ")
+		} else {
+			sb.WriteString(" ")
+		}
+		fmt.Fprintf(&sb, "%s=%v", f.Key, f.Value)
+	}
+	return sb.String()
+}
+
+// withFields returns a logger that attaches given fields to every message
+func withFields(logger Logger, fields ...Field) Logger {
+	return fieldLogger{logger: logger, fields: fields}
+}
+
+type fieldLogger struct {
+	logger Logger
+	fields []Field
+}
+
+func (l fieldLogger) Debug(msg string, fields ...Field) {
+	l.logger.Debug(msg, l.merge(fields)...)
+}
+
+func (l fieldLogger) Info(msg string, fields ...Field) {
+	l.logger.Info(msg, l.merge(fields)...)
+}
+
+func (l fieldLogger) Warn(msg string, fields ...Field) {
+	l.logger.Warn(msg, l.merge(fields)...)
+}
+
+func (l fieldLogger) Error(msg string, fields ...Field) {
+	l.logger.Error(msg, l.merge(fields)...)
+}
+
+func (l fieldLogger) merge(fields []Field) []Field {
+	merged := make([]Field, 0, len(fields)+len(l.fields))
+	return append(append(merged, fields...), l.fields...)
+}
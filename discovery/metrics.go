@@ -0,0 +1,211 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics collects metrics of service registration and discovery. Metrics implements
+// prometheus.Collector and has to be registered with a Prometheus registry, for example:
+//
+//	metrics := discovery.NewMetrics()
+//	prometheus.MustRegister(metrics)
+//	disc := discovery.New(discovery.Options{Extension: "consul", Metrics: metrics})
+//
+// A nil *Metrics collects nothing.
+type Metrics struct {
+	discoveries         *prometheus.CounterVec
+	discoveryDuration   *prometheus.HistogramVec
+	staleFallbacks      *prometheus.CounterVec
+	backendDuration     *prometheus.HistogramVec
+	registered          *prometheus.GaugeVec
+	heartbeatFailures   *prometheus.CounterVec
+	retryDelay          *prometheus.GaugeVec
+	discoveredInstances *prometheus.GaugeVec
+	gatewayURLUpdates   *prometheus.CounterVec
+}
+
+// NewMetrics creates a new metrics collector.
+func NewMetrics() *Metrics {
+	const namespace = "kumuluzee_discovery"
+	return &Metrics{
+		discoveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "discoveries_total",
+			Help:      "Number of service discovery calls by discovered service and result (success or error).",
+		}, []string{"service", "result"}),
+		discoveryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "discovery_duration_seconds",
+			Help:      "Duration of service discovery calls by discovered service.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"service"}),
+		staleFallbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "stale_fallbacks_total",
+			Help:      "Number of service discovery calls that returned the last known service.",
+		}, []string{"service"}),
+		backendDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "backend_request_duration_seconds",
+			Help:      "Duration of requests to the discovery backend by backend, operation and result.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"backend", "operation", "result"}),
+		registered: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "registered",
+			Help:      "Registration state of service instances registered by this process (1 if registered, 0 otherwise).",
+		}, []string{"service", "instance_id"}),
+		heartbeatFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "heartbeat_failures_total",
+			Help:      "Number of failed TTL updates of service instances registered by this process.",
+		}, []string{"service", "instance_id"}),
+		retryDelay: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "retry_delay_seconds",
+			Help:      "Current registration retry delay of service instances registered by this process (0 if not retrying).",
+		}, []string{"service", "instance_id"}),
+		discoveredInstances: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "discovered_instances",
+			Help:      "Number of instances returned by the backend in the last discovery of a service.",
+		}, []string{"service"}),
+		gatewayURLUpdates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "gateway_url_updates_total",
+			Help:      "Number of gateway URL updates received by watches, by service version namespace.",
+		}, []string{"namespace"}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.discoveries,
+		m.discoveryDuration,
+		m.staleFallbacks,
+		m.backendDuration,
+		m.registered,
+		m.heartbeatFailures,
+		m.retryDelay,
+		m.discoveredInstances,
+		m.gatewayURLUpdates,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// functions below are called by Util and discovery sources, and do nothing on nil *Metrics
+
+func (m *Metrics) observeDiscovery(service string, err error, start time.Time) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.discoveries.WithLabelValues(service, result).Inc()
+	m.discoveryDuration.WithLabelValues(service).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) staleFallback(service string) {
+	if m == nil {
+		return
+	}
+	m.staleFallbacks.WithLabelValues(service).Inc()
+}
+
+func (m *Metrics) observeBackendRequest(backend, operation string, err error, start time.Time) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.backendDuration.WithLabelValues(backend, operation, result).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) setRegistered(service, instanceID string, registered bool) {
+	if m == nil {
+		return
+	}
+	value := 0.0
+	if registered {
+		value = 1
+	}
+	m.registered.WithLabelValues(service, instanceID).Set(value)
+}
+
+func (m *Metrics) heartbeatFailed(service, instanceID string) {
+	if m == nil {
+		return
+	}
+	m.heartbeatFailures.WithLabelValues(service, instanceID).Inc()
+}
+
+func (m *Metrics) setRetryDelay(service, instanceID string, retryDelayMs int64) {
+	if m == nil {
+		return
+	}
+	m.retryDelay.WithLabelValues(service, instanceID).Set(float64(retryDelayMs) / 1000)
+}
+
+func (m *Metrics) setDiscoveredInstances(service string, count int) {
+	if m == nil {
+		return
+	}
+	m.discoveredInstances.WithLabelValues(service).Set(float64(count))
+}
+
+func (m *Metrics) gatewayURLUpdated(namespace string) {
+	if m == nil {
+		return
+	}
+	m.gatewayURLUpdates.WithLabelValues(namespace).Inc()
+}
+
+// instance is no longer registered, its series are removed
+func (m *Metrics) deregistered(service, instanceID string) {
+	if m == nil {
+		return
+	}
+	m.registered.DeleteLabelValues(service, instanceID)
+	m.heartbeatFailures.DeleteLabelValues(service, instanceID)
+	m.retryDelay.DeleteLabelValues(service, instanceID)
+}
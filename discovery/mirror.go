@@ -0,0 +1,349 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Actions of mirror changes
+const (
+	MirrorRegister     = "register"
+	MirrorUpdate       = "update"
+	MirrorDeregister   = "deregister"
+	MirrorSetGateway   = "set-gateway"
+	MirrorClearGateway = "clear-gateway"
+)
+
+// MirrorOptions configures a Mirror.
+type MirrorOptions struct {
+	// Environment to mirror. If empty, all environments are mirrored.
+	Environment string
+	// Interval between synchronizations, performed by Mirror.Run.
+	// Default value is 10 seconds.
+	Interval time.Duration
+	// If DryRun is true, changes are computed and returned, but not applied to the target.
+	DryRun bool
+}
+
+// MirrorChange is a change of the target registry, applied (or planned, in dry run) by Mirror.
+type MirrorChange struct {
+	// Action is one of discovery.Mirror* constants.
+	Action string
+	// Instance is set for instance changes. For MirrorDeregister, it is the deregistered target instance.
+	Instance Instance
+	// Gateway is set for gateway URL changes.
+	Gateway GatewayURL
+	// Err is set if applying the change failed.
+	Err error
+}
+
+// String formats the change as a diff line, e.g. "+ instance dev/customer-service/1.0.0 <id> <url>".
+func (c MirrorChange) String() string {
+	var line string
+	switch c.Action {
+	case MirrorRegister, MirrorUpdate, MirrorDeregister:
+		sign := map[string]string{MirrorRegister: "+", MirrorUpdate: "~", MirrorDeregister: "-"}[c.Action]
+		line = fmt.Sprintf("%s instance %s/%s/%s %s %s status=%s weight=%d",
+			sign, c.Instance.Environment, c.Instance.Service, c.Instance.Version, c.Instance.ID, c.Instance.URL,
+			c.Instance.Status, c.Instance.Weight)
+	case MirrorSetGateway:
+		line = fmt.Sprintf("+ gateway %s/%s/%s %s", c.Gateway.Environment, c.Gateway.Service, c.Gateway.Version, c.Gateway.URL)
+	case MirrorClearGateway:
+		line = fmt.Sprintf("- gateway %s/%s/%s %s", c.Gateway.Environment, c.Gateway.Service, c.Gateway.Version, c.Gateway.URL)
+	}
+	if c.Err != nil {
+		line += " (failed: " + c.Err.Error() + ")"
+	}
+	return line
+}
+
+// Mirror copies instances and gateway URLs from one registry (source) to another (target), e.g.
+// during a migration from etcd to Consul. Healthy source instances are registered in the target as
+// static instances with the same id, and marked with the name of the source backend (see
+// Instance.MirroredFrom). Mirrored instances are registered with a TTL of three intervals, which
+// is refreshed by each synchronization, so they expire if the mirror stops. They are updated when
+// they change in the source, and deregistered when they disappear from it. Instances registered in
+// the target by services are never changed. Gateway URLs are copied and marked with the name of
+// the source backend (see GatewayURL.MirroredFrom), and cleared from the target if they are later
+// removed from the source.
+//
+// Source and target are Utils, created with discovery.New with different extensions.
+type Mirror struct {
+	source  Util
+	target  Util
+	options MirrorOptions
+}
+
+// TTL of mirrored instances, in synchronization intervals
+const mirrorTTLIntervals = 3
+
+// NewMirror creates a new Mirror from source to target.
+func NewMirror(source, target Util, options MirrorOptions) *Mirror {
+	if options.Interval <= 0 {
+		options.Interval = 10 * time.Second
+	}
+	return &Mirror{
+		source:  source,
+		target:  target,
+		options: options,
+	}
+}
+
+// Run synchronizes the target every MirrorOptions.Interval until ctx is done. Changes of each
+// synchronization are passed to report (if not nil). Failed synchronizations are logged and retried
+// in the next interval.
+func (m *Mirror) Run(ctx context.Context, report func([]MirrorChange)) {
+	ticker := time.NewTicker(m.options.Interval)
+	defer ticker.Stop()
+	for {
+		changes, err := m.Sync()
+		if err != nil {
+			m.target.Logger.Error("Mirror synchronization failed", F("from", m.source.extension), F("to", m.target.extension), errField(err))
+		}
+		if report != nil && len(changes) > 0 {
+			report(changes)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync synchronizes the target once and returns the changes. In dry run, changes are only computed.
+// Errors of individual changes are reported in MirrorChange.Err, the returned error is only set if
+// listing the source or the target failed.
+func (m *Mirror) Sync() ([]MirrorChange, error) {
+	sourceInstances, err := m.source.ListInstances(m.options.Environment, "")
+	if err != nil {
+		return nil, fmt.Errorf("listing source instances failed: %s", err.Error())
+	}
+	targetInstances, err := m.target.ListInstances(m.options.Environment, "")
+	if err != nil {
+		return nil, fmt.Errorf("listing target instances failed: %s", err.Error())
+	}
+
+	var changes []MirrorChange
+
+	mirrored := make(map[string]Instance)
+	native := make(map[string]bool)
+	for _, instance := range targetInstances {
+		if instance.MirroredFrom == m.source.extension {
+			mirrored[instance.ID] = instance
+		} else {
+			native[instance.ID] = true
+		}
+	}
+
+	sortInstances(sourceInstances)
+	seen := make(map[string]bool)
+	for _, instance := range sourceInstances {
+		// instances mirrored into the source are not mirrored back
+		if !instance.Healthy || instance.MirroredFrom == m.target.extension {
+			continue
+		}
+		if native[instance.ID] {
+			m.target.Logger.Warn("Not mirroring instance, target has an instance with the same id",
+				serviceField(instance.Service), instanceField(instance.ID))
+			continue
+		}
+		seen[instance.ID] = true
+		instance.MirroredFrom = m.source.extension
+
+		old, ok := mirrored[instance.ID]
+		switch {
+		case !ok:
+			change := MirrorChange{Action: MirrorRegister, Instance: instance}
+			change.Err = m.apply(func() error { return m.register(instance, InstanceEnabled) })
+			changes = append(changes, change)
+		case !sameInstance(old, instance):
+			change := MirrorChange{Action: MirrorUpdate, Instance: instance}
+			change.Err = m.apply(func() error {
+				// version is a part of etcd key, instance with old version has to be removed
+				if old.Version != instance.Version {
+					if err := m.target.discoverySource.DeregisterInstance(old.Environment, old.Service, old.ID); err != nil {
+						return err
+					}
+					return m.register(instance, InstanceEnabled)
+				}
+				return m.register(instance, old.Status)
+			})
+			changes = append(changes, change)
+		default:
+			// instance is registered again if its TTL can't be refreshed, e.g. if it was mirrored
+			// without TTL
+			err := m.apply(func() error {
+				if err := m.target.discoverySource.refreshStaticInstance(m.staticInstance(instance)); err != nil {
+					return m.register(instance, old.Status)
+				}
+				return nil
+			})
+			if err != nil {
+				m.target.Logger.Warn("Refreshing TTL of mirrored instance failed", serviceField(instance.Service), instanceField(instance.ID), errField(err))
+			}
+		}
+	}
+
+	sortInstances(targetInstances)
+	for _, instance := range targetInstances {
+		if _, ok := mirrored[instance.ID]; ok && !seen[instance.ID] {
+			change := MirrorChange{Action: MirrorDeregister, Instance: instance}
+			change.Err = m.apply(func() error {
+				return m.target.discoverySource.DeregisterInstance(instance.Environment, instance.Service, instance.ID)
+			})
+			changes = append(changes, change)
+		}
+	}
+
+	gatewayChanges, err := m.syncGatewayURLs()
+	if err != nil {
+		return changes, err
+	}
+	return append(changes, gatewayChanges...), nil
+}
+
+func (m *Mirror) syncGatewayURLs() ([]MirrorChange, error) {
+	sourceURLs, err := m.source.ListGatewayURLs(m.options.Environment)
+	if err != nil {
+		return nil, fmt.Errorf("listing source gateway URLs failed: %s", err.Error())
+	}
+	targetURLs, err := m.target.ListGatewayURLs(m.options.Environment)
+	if err != nil {
+		return nil, fmt.Errorf("listing target gateway URLs failed: %s", err.Error())
+	}
+
+	current := make(map[string]string)
+	for _, gw := range targetURLs {
+		current[serviceVersionNamespace(gw.Environment, gw.Service, gw.Version)] = gw.URL
+	}
+
+	// gateway URLs are marked in the target, so they can be cleared after a restart of the mirror
+	markerKey := func(gw GatewayURL) string {
+		return serviceVersionNamespace(gw.Environment, gw.Service, gw.Version) + "/" + gatewayURLMirroredFromKey
+	}
+
+	var changes []MirrorChange
+	inSource := make(map[string]bool)
+	for _, gw := range sourceURLs {
+		namespace := serviceVersionNamespace(gw.Environment, gw.Service, gw.Version)
+		inSource[namespace] = true
+		if current[namespace] == gw.URL {
+			continue
+		}
+		gw := gw
+		change := MirrorChange{Action: MirrorSetGateway, Gateway: gw}
+		change.Err = m.apply(func() error {
+			if err := m.target.SetGatewayURL(gw.Environment, gw.Service, gw.Version, gw.URL); err != nil {
+				return err
+			}
+			return m.target.discoverySource.SetKey(markerKey(gw), m.source.extension)
+		})
+		changes = append(changes, change)
+	}
+
+	for _, gw := range targetURLs {
+		if gw.MirroredFrom != m.source.extension || inSource[serviceVersionNamespace(gw.Environment, gw.Service, gw.Version)] {
+			continue
+		}
+		gw := gw
+		change := MirrorChange{Action: MirrorClearGateway, Gateway: gw}
+		change.Err = m.apply(func() error {
+			return m.target.ClearGatewayURL(gw.Environment, gw.Service, gw.Version)
+		})
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
+
+// runs fn, unless in dry run
+func (m *Mirror) apply(fn func() error) error {
+	if m.options.DryRun {
+		return nil
+	}
+	return fn()
+}
+
+// returns static instance, which instance is mirrored as
+func (m *Mirror) staticInstance(instance Instance) StaticInstance {
+	return StaticInstance{
+		Environment:  instance.Environment,
+		Service:      instance.Service,
+		Version:      instance.Version,
+		ID:           instance.ID,
+		URL:          instance.URL,
+		Addresses:    instance.Addresses,
+		Weight:       instance.Weight,
+		Zone:         instance.Zone,
+		Region:       instance.Region,
+		MirroredFrom: instance.MirroredFrom,
+		TTL:          mirrorTTLIntervals * m.options.Interval,
+	}
+}
+
+// registers instance in the target, and sets its status if it differs from current status
+func (m *Mirror) register(instance Instance, currentStatus InstanceStatus) error {
+	_, err := m.target.discoverySource.RegisterStaticInstance(m.staticInstance(instance))
+	if err != nil {
+		return err
+	}
+	if instance.Status != currentStatus {
+		return m.target.discoverySource.SetInstanceStatus(instance.ID, instance.Status)
+	}
+	return nil
+}
+
+// compares mirrored properties of instances
+func sameInstance(a, b Instance) bool {
+	if len(a.Addresses) == 0 && len(b.Addresses) == 0 {
+		a.Addresses, b.Addresses = nil, nil
+	}
+	return a.Environment == b.Environment &&
+		a.Service == b.Service &&
+		a.Version == b.Version &&
+		a.URL == b.URL &&
+		reflect.DeepEqual(a.Addresses, b.Addresses) &&
+		a.Status == b.Status &&
+		a.Weight == b.Weight &&
+		a.Zone == b.Zone &&
+		a.Region == b.Region
+}
+
+func sortInstances(instances []Instance) {
+	sort.Slice(instances, func(i, j int) bool {
+		a, b := instances[i], instances[j]
+		if a.Environment != b.Environment {
+			return a.Environment < b.Environment
+		}
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		return a.ID < b.ID
+	})
+}
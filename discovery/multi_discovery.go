@@ -0,0 +1,457 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Possible values of Options.MultiDiscovery
+const (
+	// MultiDiscoveryPriority discovers from the first backend (in order of Options.Extensions) that
+	// has a usable instance.
+	MultiDiscoveryPriority = "priority"
+	// MultiDiscoveryMerge discovers from instances of all backends. Instances with the same direct
+	// URL (e.g. mirrored instances) are only counted once.
+	MultiDiscoveryMerge = "merge"
+)
+
+// discovery source, whose instances can be combined with instances of other sources
+type instanceSource interface {
+	discoverySource
+
+	discoverInstances(ctx context.Context, options DiscoverOptions) ([]discoveredService, error)
+	gatewayURLWatches() []*gatewayURLWatch
+	trafficSplitRules(environment, service string) []TrafficSplitRule
+}
+
+// combines several discovery sources: registers into all of them and discovers from them in
+// priority order or from merged instances
+type multiDiscoverySource struct {
+	names   []string
+	sources []instanceSource
+	mode    string
+
+	discoverOptions discoverConfiguration
+	outliers        *outlierDetector // shared with Util
+
+	registrationsMutex sync.Mutex
+	serviceIDs         []string            // ids returned by RegisterService, in order of registration
+	registrations      map[string][]string // ids in each of sources (by index), by service id
+
+	lastKnownServices lastKnownServices // last known service of each discovered service
+
+	logger  Logger
+	metrics *Metrics
+}
+
+func newMultiDiscoverySource(names []string, sources []instanceSource, mode string, discoverOptions discoverConfiguration,
+	outliers *outlierDetector, logger Logger, metrics *Metrics) discoverySource {
+
+	if mode == "" {
+		mode = MultiDiscoveryPriority
+	}
+	logger.Debug("Initializing multi-backend discovery source", F("backends", names), F("mode", mode))
+	return &multiDiscoverySource{
+		names:           names,
+		sources:         sources,
+		mode:            mode,
+		discoverOptions: discoverOptions,
+		outliers:        outliers,
+		registrations:   make(map[string][]string),
+		logger:          logger,
+		metrics:         metrics,
+	}
+}
+
+// instance is registered with each of sources, id of the first successful registration is returned
+func (d *multiDiscoverySource) RegisterService(options RegisterOptions) (string, error) {
+	ids := make([]string, len(d.sources))
+	var serviceID string
+	var lastErr error
+	for i, src := range d.sources {
+		id, err := src.RegisterService(options)
+		if err != nil {
+			d.logger.Error("Service registration failed", serviceField(options.Value), F(FieldBackend, d.names[i]), errField(err))
+			lastErr = err
+			continue
+		}
+		ids[i] = id
+		if serviceID == "" {
+			serviceID = id
+		}
+	}
+	if serviceID == "" {
+		return "", lastErr
+	}
+
+	d.registrationsMutex.Lock()
+	d.serviceIDs = append(d.serviceIDs, serviceID)
+	d.registrations[serviceID] = ids
+	d.registrationsMutex.Unlock()
+	return serviceID, nil
+}
+
+func (d *multiDiscoverySource) DeregisterService() error {
+	d.registrationsMutex.Lock()
+	d.serviceIDs = nil
+	d.registrations = make(map[string][]string)
+	d.registrationsMutex.Unlock()
+
+	var lastErr error
+	for _, src := range d.sources {
+		if err := src.DeregisterService(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (d *multiDiscoverySource) DiscoverService(ctx context.Context, options DiscoverOptions) (string, error) {
+	fillDefaultDiscoverOptions(&options, d.discoverOptions)
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attrEnvironment.String(options.Environment), attrVersionRange.String(options.Version))
+
+	if options.ConnectMode == ConnectModeUpstream {
+		// only Consul knows local upstream listeners, instance URLs of other backends would bypass
+		// Connect
+		for i, src := range d.sources {
+			if d.names[i] == "consul" {
+				return src.DiscoverService(ctx, options)
+			}
+		}
+		err := fmt.Errorf("connect mode %s requires consul backend", ConnectModeUpstream)
+		d.logger.Error("Service discovery failed", serviceField(options.Value), errField(err))
+		return "", err
+	}
+
+	service, err := d.discover(ctx, options)
+	for _, environment := range options.FallbackEnvironments {
+		if err == nil {
+			break
+		}
+		fallback := options
+		fallback.Environment = environment
+		if fallbackService, fallbackErr := d.discover(ctx, fallback); fallbackErr == nil {
+			d.logger.Info("No usable instances in environment, using fallback environment", serviceField(options.Value),
+				F("environment", options.Environment), F("fallback_environment", environment))
+			span.SetAttributes(attrEnvironment.String(environment))
+			service, err = fallbackService, nil
+		}
+	}
+
+	if err != nil {
+		if lastKnown := d.lastKnownServices.get(options); lastKnown != "" {
+			d.logger.Warn("Service discovery failed, using last known service", serviceField(options.Value), errField(err))
+			d.metrics.staleFallback(options.Value)
+			markStale(ctx)
+			return lastKnown, nil
+		}
+		d.logger.Error("Service discovery failed", serviceField(options.Value), errField(err))
+		return "", err
+	}
+
+	span.SetAttributes(attrFallback.Bool(false))
+	d.lastKnownServices.set(options, service)
+	return service, nil
+}
+
+// discovers service in all backends, according to the mode
+func (d *multiDiscoverySource) discover(ctx context.Context, options DiscoverOptions) (string, error) {
+	if d.mode == MultiDiscoveryMerge {
+		return d.discoverMerged(ctx, options)
+	}
+	return d.discoverByPriority(ctx, options)
+}
+
+func (d *multiDiscoverySource) discoverByPriority(ctx context.Context, options DiscoverOptions) (string, error) {
+	var lastErr error
+	for i, src := range d.sources {
+		instances, err := src.discoverInstances(ctx, options)
+		if err == nil {
+			trafficSplit := src.trafficSplitRules(options.Environment, options.Value)
+			var service string
+			service, err = pickRandomServiceInstance(instances, src.gatewayURLWatches(), trafficSplit, d.outliers, options, "")
+			if err == nil {
+				return service, nil
+			}
+		}
+		d.logger.Debug("Service discovery failed, trying next backend", serviceField(options.Value), F(FieldBackend, d.names[i]), errField(err))
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+func (d *multiDiscoverySource) discoverMerged(ctx context.Context, options DiscoverOptions) (string, error) {
+	var merged []discoveredService
+	var gatewayURLs []*gatewayURLWatch
+	var trafficSplit []TrafficSplitRule
+	seen := make(map[string]bool)
+	failed := 0
+	var lastErr error
+	for i, src := range d.sources {
+		instances, err := src.discoverInstances(ctx, options)
+		if err != nil {
+			d.logger.Warn("Service discovery failed, using instances of other backends", serviceField(options.Value), F(FieldBackend, d.names[i]), errField(err))
+			failed++
+			lastErr = err
+			continue
+		}
+		for _, instance := range instances {
+			// mirrored instances have the same URL in all backends, but not necessarily the same id
+			key := instance.directURL
+			if key == "" {
+				key = instance.id
+			}
+			if !seen[key] {
+				seen[key] = true
+				merged = append(merged, instance)
+			}
+		}
+		gatewayURLs = append(gatewayURLs, src.gatewayURLWatches()...)
+		if len(trafficSplit) == 0 {
+			trafficSplit = src.trafficSplitRules(options.Environment, options.Value)
+		}
+	}
+	if failed == len(d.sources) {
+		return "", lastErr
+	}
+	return pickRandomServiceInstance(merged, gatewayURLs, trafficSplit, d.outliers, options, "")
+}
+
+func (d *multiDiscoverySource) SetInstanceStatus(serviceID string, status InstanceStatus) error {
+	return d.forEachBackendID(serviceID, func(src instanceSource, id string) error {
+		return src.SetInstanceStatus(id, status)
+	})
+}
+
+func (d *multiDiscoverySource) SetInstanceWeight(serviceID string, weight int) error {
+	return d.forEachBackendID(serviceID, func(src instanceSource, id string) error {
+		return src.SetInstanceWeight(id, weight)
+	})
+}
+
+func (d *multiDiscoverySource) RegisteredServiceIDs() []string {
+	d.registrationsMutex.Lock()
+	defer d.registrationsMutex.Unlock()
+	return append([]string(nil), d.serviceIDs...)
+}
+
+// keys (gateway URLs, traffic splits) are written to all backends
+func (d *multiDiscoverySource) SetKey(key, value string) error {
+	var lastErr error
+	for _, src := range d.sources {
+		if err := src.SetKey(key, value); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (d *multiDiscoverySource) DeleteKey(key string) error {
+	var lastErr error
+	for _, src := range d.sources {
+		if err := src.DeleteKey(key); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// gateway URL of a service version is taken from the first backend that has it
+func (d *multiDiscoverySource) ListGatewayURLs(environment string) ([]GatewayURL, error) {
+	var gatewayURLs []GatewayURL
+	seen := make(map[string]bool)
+	for _, src := range d.sources {
+		urls, err := src.ListGatewayURLs(environment)
+		if err != nil {
+			return nil, err
+		}
+		for _, gw := range urls {
+			namespace := serviceVersionNamespace(gw.Environment, gw.Service, gw.Version)
+			if !seen[namespace] {
+				seen[namespace] = true
+				gatewayURLs = append(gatewayURLs, gw)
+			}
+		}
+	}
+	return gatewayURLs, nil
+}
+
+// instances with the same id are listed once, as returned by the first backend
+func (d *multiDiscoverySource) ListInstances(environment, service string) ([]Instance, error) {
+	var instances []Instance
+	seen := make(map[string]bool)
+	for _, src := range d.sources {
+		listed, err := src.ListInstances(environment, service)
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range listed {
+			if !seen[instance.ID] {
+				seen[instance.ID] = true
+				instances = append(instances, instance)
+			}
+		}
+	}
+	return instances, nil
+}
+
+// static instance is registered with the same id in all backends. Registration is attempted in
+// every backend, id is returned if it succeeded in any of them, together with errors of the others.
+func (d *multiDiscoverySource) RegisterStaticInstance(instance StaticInstance) (string, error) {
+	var errs []error
+	registered := false
+	for i, src := range d.sources {
+		id, err := src.RegisterStaticInstance(instance)
+		if err != nil {
+			d.logger.Error("Static instance registration failed", serviceField(instance.Service), F(FieldBackend, d.names[i]), errField(err))
+			errs = append(errs, fmt.Errorf("%s: %s", d.names[i], err.Error()))
+			continue
+		}
+		instance.ID = id
+		registered = true
+	}
+	if !registered {
+		return "", joinErrors(errs)
+	}
+	return instance.ID, joinErrors(errs)
+}
+
+func (d *multiDiscoverySource) refreshStaticInstance(instance StaticInstance) error {
+	var errs []error
+	for i, src := range d.sources {
+		if err := src.refreshStaticInstance(instance); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", d.names[i], err.Error()))
+		}
+	}
+	return joinErrors(errs)
+}
+
+func (d *multiDiscoverySource) DeregisterInstance(environment, service, instanceID string) error {
+	err := d.forEachBackendID(instanceID, func(src instanceSource, id string) error {
+		return src.DeregisterInstance(environment, service, id)
+	})
+
+	d.registrationsMutex.Lock()
+	if _, ok := d.registrations[instanceID]; ok {
+		delete(d.registrations, instanceID)
+		for i, id := range d.serviceIDs {
+			if id == instanceID {
+				d.serviceIDs = append(d.serviceIDs[:i], d.serviceIDs[i+1:]...)
+				break
+			}
+		}
+	}
+	d.registrationsMutex.Unlock()
+	return err
+}
+
+func (d *multiDiscoverySource) adminState() sourceState {
+	// ids of registrations in each backend, mapped to service ids
+	serviceIDs := make(map[string]string)
+	d.registrationsMutex.Lock()
+	for serviceID, ids := range d.registrations {
+		for _, id := range ids {
+			if id != "" {
+				serviceIDs[id] = serviceID
+			}
+		}
+	}
+	d.registrationsMutex.Unlock()
+
+	state := sourceState{
+		Backend:           strings.Join(d.names, ","),
+		Registrations:     []Registration{},
+		Cache:             []cacheEntry{},
+		GatewayURLWatches: []gatewayURLWatchState{},
+		LastKnownServices: d.lastKnownServices.all(),
+	}
+	for _, src := range d.sources {
+		s := src.adminState()
+		for _, r := range s.Registrations {
+			if serviceID, ok := serviceIDs[r.ID]; ok {
+				r.ServiceID = serviceID
+			}
+			state.Registrations = append(state.Registrations, r)
+		}
+		state.Cache = append(state.Cache, s.Cache...)
+		state.GatewayURLWatches = append(state.GatewayURLWatches, s.GatewayURLWatches...)
+	}
+	return state
+}
+
+// calls fn with ids of instance with given service id in each backend. Ids not registered by this
+// source are passed to all backends, and fn has to succeed with at least one of them
+func (d *multiDiscoverySource) forEachBackendID(serviceID string, fn func(src instanceSource, id string) error) error {
+	d.registrationsMutex.Lock()
+	ids, registered := d.registrations[serviceID]
+	d.registrationsMutex.Unlock()
+
+	var lastErr error
+	if registered {
+		for i, id := range ids {
+			if id == "" {
+				continue
+			}
+			if err := fn(d.sources[i], id); err != nil {
+				d.logger.Warn("Updating instance failed", instanceField(id), F(FieldBackend, d.names[i]), errField(err))
+				lastErr = err
+			}
+		}
+		return lastErr
+	}
+
+	succeeded := false
+	for _, src := range d.sources {
+		if err := fn(src, serviceID); err != nil {
+			lastErr = err
+		} else {
+			succeeded = true
+		}
+	}
+	if succeeded {
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("instance with id %s not found", serviceID)
+	}
+	return lastErr
+}
+
+// joins messages of errors with "; ", returns nil if there are no errors
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return fmt.Errorf("%s", strings.Join(messages, "; "))
+}
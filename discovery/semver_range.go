@@ -0,0 +1,398 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/blang/semver"
+)
+
+// Version ranges follow npm (node-semver) semantics: x-ranges (1.x, 1.2.*), tilde ranges (~1.2.3),
+// caret ranges (^1.2.3, ^0.2.3, ^0.0.3), hyphen ranges (1.2.3 - 2.3.4), comparator sets separated
+// by whitespace (>=1.2.3 <2.0.0) and unions of sets (^1.0.0 || ^2.0.0).
+//
+// Prerelease versions (e.g. 2.0.0-rc.1) only match a comparator set if one of its comparators is a
+// prerelease of the same major.minor.patch, unless includePrerelease is set.
+
+// partial version, e.g. 1, 1.2, 1.x, 1.2.3-rc.1+build
+var partialVersionRegexp = regexp.MustCompile(`^[v=]*(\d+|[xX*])(?:\.(\d+|[xX*])(?:\.(\d+|[xX*])(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?(?:\+[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?)?)?$`)
+
+// comparator operator, followed by optional whitespace and a version
+var comparatorOperatorRegexp = regexp.MustCompile(`(<=|>=|<|>|=|~>|~|\^)\s+`)
+
+// hyphen range, e.g. 1.2.3 - 2.3.4
+var hyphenRangeRegexp = regexp.MustCompile(`^\s*(\S+)\s+-\s+(\S+)\s*$`)
+
+type comparator struct {
+	operator string // one of <, <=, >, >=, = or empty string for any version
+	version  semver.Version
+}
+
+type partialVersion struct {
+	major, minor, patch    uint64
+	xMajor, xMinor, xPatch bool
+	pre                    []semver.PRVersion
+}
+
+func (p partialVersion) anyX() bool {
+	return p.xMajor || p.xMinor || p.xPatch
+}
+
+// parses version range with npm semantics, without prerelease matching
+func parseVersion(version string) (semver.Range, error) {
+	return parseVersionRange(version, false)
+}
+
+// parses version range with npm semantics. If includePrerelease is true, prerelease versions
+// match ranges like any other version.
+func parseVersionRange(versionRange string, includePrerelease bool) (semver.Range, error) {
+	var sets [][]comparator
+	for _, set := range strings.Split(versionRange, "||") {
+		comparators, err := parseComparatorSet(set, includePrerelease)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, comparators)
+	}
+
+	return func(v semver.Version) bool {
+		for _, set := range sets {
+			if testComparatorSet(set, v, includePrerelease) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func parseComparatorSet(set string, includePrerelease bool) ([]comparator, error) {
+	set = strings.TrimSpace(set)
+
+	if m := hyphenRangeRegexp.FindStringSubmatch(set); m != nil {
+		from, err := parsePartialVersion(m[1])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parsePartialVersion(m[2])
+		if err != nil {
+			return nil, err
+		}
+		return hyphenRange(from, to, includePrerelease), nil
+	}
+
+	// ">= 1.2.3" is the same as ">=1.2.3"
+	set = comparatorOperatorRegexp.ReplaceAllString(set, "$1")
+
+	comparators := []comparator{}
+	for _, token := range strings.Fields(set) {
+		c, err := parseComparator(token, includePrerelease)
+		if err != nil {
+			return nil, err
+		}
+		comparators = append(comparators, c...)
+	}
+	if len(comparators) == 0 {
+		// empty set matches any version
+		comparators = append(comparators, comparator{})
+	}
+	return comparators, nil
+}
+
+func parseComparator(token string, includePrerelease bool) ([]comparator, error) {
+	var operator string
+	for _, op := range []string{"~>", "<=", ">=", "<", ">", "=", "~", "^"} {
+		if strings.HasPrefix(token, op) {
+			operator = op
+			break
+		}
+	}
+
+	p, err := parsePartialVersion(token[len(operator):])
+	if err != nil {
+		return nil, err
+	}
+
+	switch operator {
+	case "~", "~>":
+		return tildeRange(p, includePrerelease), nil
+	case "^":
+		return caretRange(p, includePrerelease), nil
+	default:
+		return xRange(operator, p, includePrerelease), nil
+	}
+}
+
+func parsePartialVersion(s string) (p partialVersion, err error) {
+	m := partialVersionRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return p, fmt.Errorf("invalid version: %s", s)
+	}
+
+	parts := []struct {
+		value string
+		n     *uint64
+		x     *bool
+	}{
+		{m[1], &p.major, &p.xMajor},
+		{m[2], &p.minor, &p.xMinor},
+		{m[3], &p.patch, &p.xPatch},
+	}
+	for i, part := range parts {
+		// missing parts and parts after an x are x as well, e.g. 1.x.3 is 1.x.x
+		if part.value == "" || part.value == "x" || part.value == "X" || part.value == "*" || (i > 0 && *parts[i-1].x) {
+			*part.x = true
+			continue
+		}
+		if *part.n, err = strconv.ParseUint(part.value, 10, 64); err != nil {
+			return p, fmt.Errorf("invalid version: %s", s)
+		}
+	}
+
+	if m[4] != "" && !p.anyX() {
+		for _, pre := range strings.Split(m[4], ".") {
+			prVersion, err := semver.NewPRVersion(pre)
+			if err != nil {
+				return p, fmt.Errorf("invalid version: %s: %s", s, err.Error())
+			}
+			p.pre = append(p.pre, prVersion)
+		}
+	}
+
+	return p, nil
+}
+
+// returns version major.minor.patch, optionally with prerelease -0, which is lower than any other
+// prerelease of the same version
+func version(major, minor, patch uint64, zeroPrerelease bool) semver.Version {
+	v := semver.Version{Major: major, Minor: minor, Patch: patch}
+	if zeroPrerelease {
+		v.Pre = []semver.PRVersion{{VersionNum: 0, IsNum: true}}
+	}
+	return v
+}
+
+// ~1.2.3 := >=1.2.3 <1.3.0-0, ~1.2 := >=1.2.0 <1.3.0-0, ~1 := >=1.0.0 <2.0.0-0
+func tildeRange(p partialVersion, includePrerelease bool) []comparator {
+	switch {
+	case p.xMajor:
+		return []comparator{{}}
+	case p.xMinor:
+		return []comparator{
+			{">=", version(p.major, 0, 0, includePrerelease)},
+			{"<", version(p.major+1, 0, 0, true)},
+		}
+	case p.xPatch:
+		return []comparator{
+			{">=", version(p.major, p.minor, 0, includePrerelease)},
+			{"<", version(p.major, p.minor+1, 0, true)},
+		}
+	default:
+		from := version(p.major, p.minor, p.patch, false)
+		from.Pre = p.pre
+		return []comparator{
+			{">=", from},
+			{"<", version(p.major, p.minor+1, 0, true)},
+		}
+	}
+}
+
+// ^1.2.3 := >=1.2.3 <2.0.0-0, ^0.2.3 := >=0.2.3 <0.3.0-0, ^0.0.3 := >=0.0.3 <0.0.4-0,
+// ^1.x := >=1.0.0 <2.0.0-0, ^0.x := >=0.0.0 <1.0.0-0, ^0.0.x := >=0.0.0 <0.1.0-0
+func caretRange(p partialVersion, includePrerelease bool) []comparator {
+	switch {
+	case p.xMajor:
+		return []comparator{{}}
+	case p.xMinor:
+		return []comparator{
+			{">=", version(p.major, 0, 0, includePrerelease)},
+			{"<", version(p.major+1, 0, 0, true)},
+		}
+	case p.xPatch:
+		from := version(p.major, p.minor, 0, includePrerelease)
+		if p.major == 0 {
+			return []comparator{{">=", from}, {"<", version(p.major, p.minor+1, 0, true)}}
+		}
+		return []comparator{{">=", from}, {"<", version(p.major+1, 0, 0, true)}}
+	default:
+		from := version(p.major, p.minor, p.patch, false)
+		from.Pre = p.pre
+		var to semver.Version
+		if p.major == 0 && p.minor == 0 {
+			to = version(0, 0, p.patch+1, true)
+		} else if p.major == 0 {
+			to = version(0, p.minor+1, 0, true)
+		} else {
+			to = version(p.major+1, 0, 0, true)
+		}
+		return []comparator{{">=", from}, {"<", to}}
+	}
+}
+
+// primitive comparators and x-ranges, e.g. 1.2.3, >=1.2.3, 1.x, >1.2, <=1
+func xRange(operator string, p partialVersion, includePrerelease bool) []comparator {
+	if operator == "=" && p.anyX() {
+		operator = ""
+	}
+
+	switch {
+	case p.xMajor:
+		if operator == ">" || operator == "<" {
+			// nothing is allowed
+			return []comparator{{"<", version(0, 0, 0, true)}}
+		}
+		return []comparator{{}}
+
+	case operator != "" && p.anyX():
+		if p.xMinor {
+			p.minor = 0
+		}
+		p.patch = 0
+
+		zeroPrerelease := includePrerelease
+		switch operator {
+		case ">":
+			// >1 := >=2.0.0, >1.2 := >=1.3.0
+			operator = ">="
+			if p.xMinor {
+				p.major++
+				p.minor = 0
+			} else {
+				p.minor++
+			}
+		case "<=":
+			// <=0.7.x := <0.8.0-0, <=1 := <2.0.0-0
+			operator = "<"
+			if p.xMinor {
+				p.major++
+			} else {
+				p.minor++
+			}
+		}
+		if operator == "<" {
+			zeroPrerelease = true
+		}
+		return []comparator{{operator, version(p.major, p.minor, p.patch, zeroPrerelease)}}
+
+	case p.xMinor:
+		return []comparator{
+			{">=", version(p.major, 0, 0, includePrerelease)},
+			{"<", version(p.major+1, 0, 0, true)},
+		}
+
+	case p.xPatch:
+		return []comparator{
+			{">=", version(p.major, p.minor, 0, includePrerelease)},
+			{"<", version(p.major, p.minor+1, 0, true)},
+		}
+
+	default:
+		if operator == "" {
+			operator = "="
+		}
+		v := version(p.major, p.minor, p.patch, false)
+		v.Pre = p.pre
+		return []comparator{{operator, v}}
+	}
+}
+
+// 1.2.3 - 2.3.4 := >=1.2.3 <=2.3.4, 1.2 - 2.3 := >=1.2.0 <2.4.0-0
+func hyphenRange(from, to partialVersion, includePrerelease bool) []comparator {
+	var comparators []comparator
+
+	switch {
+	case from.xMajor:
+	case from.xMinor:
+		comparators = append(comparators, comparator{">=", version(from.major, 0, 0, includePrerelease)})
+	case from.xPatch:
+		comparators = append(comparators, comparator{">=", version(from.major, from.minor, 0, includePrerelease)})
+	default:
+		v := version(from.major, from.minor, from.patch, includePrerelease && len(from.pre) == 0)
+		if len(from.pre) > 0 {
+			v.Pre = from.pre
+		}
+		comparators = append(comparators, comparator{">=", v})
+	}
+
+	switch {
+	case to.xMajor:
+	case to.xMinor:
+		comparators = append(comparators, comparator{"<", version(to.major+1, 0, 0, true)})
+	case to.xPatch:
+		comparators = append(comparators, comparator{"<", version(to.major, to.minor+1, 0, true)})
+	case len(to.pre) > 0:
+		v := version(to.major, to.minor, to.patch, false)
+		v.Pre = to.pre
+		comparators = append(comparators, comparator{"<=", v})
+	case includePrerelease:
+		comparators = append(comparators, comparator{"<", version(to.major, to.minor, to.patch+1, true)})
+	default:
+		comparators = append(comparators, comparator{"<=", version(to.major, to.minor, to.patch, false)})
+	}
+
+	if len(comparators) == 0 {
+		comparators = append(comparators, comparator{})
+	}
+	return comparators
+}
+
+func (c comparator) test(v semver.Version) bool {
+	switch c.operator {
+	case "":
+		return true
+	case "<":
+		return v.LT(c.version)
+	case "<=":
+		return v.LTE(c.version)
+	case ">":
+		return v.GT(c.version)
+	case ">=":
+		return v.GTE(c.version)
+	default:
+		return v.EQ(c.version)
+	}
+}
+
+func testComparatorSet(set []comparator, v semver.Version, includePrerelease bool) bool {
+	for _, c := range set {
+		if !c.test(v) {
+			return false
+		}
+	}
+
+	if len(v.Pre) > 0 && !includePrerelease {
+		// prerelease version only matches if a comparator explicitly allows prereleases of the
+		// same major.minor.patch, e.g. 2.0.0-rc.2 matches >=2.0.0-rc.1, but not >=1.0.0
+		for _, c := range set {
+			if c.operator != "" && len(c.version.Pre) > 0 &&
+				c.version.Major == v.Major && c.version.Minor == v.Minor && c.version.Patch == v.Patch {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,142 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ShutdownOptions is used when shutting down gracefully with Util.GracefulShutdown or
+// Util.RunUntilSignal.
+type ShutdownOptions struct {
+	// Time to wait after instances are marked as draining, so that clients can refresh their
+	// discovery caches before instances stop serving.
+	// Default value is 5 seconds. A negative value disables the delay.
+	PropagationDelay time.Duration
+	// HTTP server to shut down after the propagation delay. Optional.
+	Server *http.Server
+	// Maximum time to wait for Server to finish serving requests.
+	// Default value is 30 seconds.
+	ShutdownTimeout time.Duration
+	// Signals that trigger the shutdown in Util.RunUntilSignal.
+	// Default value is SIGINT and SIGTERM.
+	Signals []os.Signal
+}
+
+func fillDefaultShutdownOptions(options *ShutdownOptions) {
+	if options.PropagationDelay == 0 {
+		options.PropagationDelay = 5 * time.Second
+	}
+	if options.ShutdownTimeout == 0 {
+		options.ShutdownTimeout = 30 * time.Second
+	}
+	if len(options.Signals) == 0 {
+		options.Signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+}
+
+// GracefulShutdown takes all services registered with this Util out of rotation and deregisters
+// them. Instances are first marked as draining, then the propagation delay passes, then the HTTP
+// server (if given) is shut down and finally all instances are deregistered. Canceling ctx skips
+// the remaining propagation delay. Returns the first error that occurred; all steps are performed
+// regardless of errors.
+func (d Util) GracefulShutdown(ctx context.Context, options ShutdownOptions) error {
+	fillDefaultShutdownOptions(&options)
+	var firstErr error
+
+	for _, id := range d.discoverySource.RegisteredServiceIDs() {
+		if err := d.discoverySource.SetInstanceStatus(id, InstanceDraining); err != nil {
+			d.Logger.Warn("Marking instance as draining failed", instanceField(id), errField(err))
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if options.PropagationDelay > 0 {
+		d.Logger.Info("Waiting for instance status to propagate", F("delay", options.PropagationDelay))
+		select {
+		case <-time.After(options.PropagationDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	if options.Server != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), options.ShutdownTimeout)
+		err := options.Server.Shutdown(shutdownCtx)
+		cancel()
+		if err != nil {
+			d.Logger.Error("HTTP server shutdown failed", errField(err))
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if err := d.DeregisterService(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return firstErr
+}
+
+// RunUntilSignal blocks until one of ShutdownOptions.Signals is received or ctx is done, then
+// performs GracefulShutdown. Returned value is an exit code: 0 if shutdown succeeded, 1 otherwise
+// or if another signal is received during shutdown. Example:
+//
+//	os.Exit(disc.RunUntilSignal(context.Background(), discovery.ShutdownOptions{Server: server}))
+func (d Util) RunUntilSignal(ctx context.Context, options ShutdownOptions) int {
+	fillDefaultShutdownOptions(&options)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, options.Signals...)
+	defer signal.Stop(sigs)
+
+	select {
+	case sig := <-sigs:
+		d.Logger.Info("Received signal, shutting down", F("signal", sig))
+	case <-ctx.Done():
+		d.Logger.Info("Context done, shutting down")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- d.GracefulShutdown(context.Background(), options)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			d.Logger.Error("Graceful shutdown failed", errField(err))
+			return 1
+		}
+		return 0
+	case sig := <-sigs:
+		d.Logger.Warn("Received signal during shutdown, exiting immediately", F("signal", sig))
+		return 1
+	}
+}
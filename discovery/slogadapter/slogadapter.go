@@ -0,0 +1,71 @@
+//go:build go1.21
+
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+// Package slogadapter adapts log/slog loggers to discovery.Logger.
+package slogadapter
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/mc0239/kumuluzee-go-discovery/discovery"
+)
+
+// New returns a discovery.Logger that writes to given slog logger.
+// Debug messages are logged with slog.LevelDebug, info with slog.LevelInfo, and so on.
+func New(l *slog.Logger) discovery.Logger {
+	return logger{l}
+}
+
+type logger struct {
+	l *slog.Logger
+}
+
+func (l logger) Debug(msg string, fields ...discovery.Field) {
+	l.log(slog.LevelDebug, msg, fields)
+}
+
+func (l logger) Info(msg string, fields ...discovery.Field) {
+	l.log(slog.LevelInfo, msg, fields)
+}
+
+func (l logger) Warn(msg string, fields ...discovery.Field) {
+	l.log(slog.LevelWarn, msg, fields)
+}
+
+func (l logger) Error(msg string, fields ...discovery.Field) {
+	l.log(slog.LevelError, msg, fields)
+}
+
+func (l logger) log(level slog.Level, msg string, fields []discovery.Field) {
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, f := range fields {
+		if err, ok := f.Value.(error); ok {
+			// errors are logged as their messages, error values often have no exported fields
+			attrs = append(attrs, slog.String(f.Key, err.Error()))
+		} else {
+			attrs = append(attrs, slog.Any(f.Key, f.Value))
+		}
+	}
+	l.l.LogAttrs(context.Background(), level, msg, attrs...)
+}
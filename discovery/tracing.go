@@ -0,0 +1,94 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/mc0239/kumuluzee-go-discovery/discovery"
+
+// span attributes
+const (
+	attrService      = attribute.Key("discovery.service")
+	attrEnvironment  = attribute.Key("discovery.environment")
+	attrVersionRange = attribute.Key("discovery.version_range")
+	attrInstanceID   = attribute.Key("discovery.instance.id")
+	attrInstanceURL  = attribute.Key("discovery.instance.url")
+	attrFallback     = attribute.Key("discovery.fallback")
+	attrBackend      = attribute.Key("discovery.backend")
+	attrDatacenter   = attribute.Key("discovery.datacenter")
+	attrStale        = attribute.Key("discovery.stale")
+)
+
+// returns tracer of given provider, or a tracer that records nothing if provider is nil
+func newTracer(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = noop.NewTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// records error (if any) and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// request to the discovery backend, traced as a client span and observed by metrics
+type backendRequest struct {
+	span      trace.Span
+	metrics   *Metrics
+	backend   string
+	operation string
+	start     time.Time
+}
+
+func startBackendRequest(ctx context.Context, tracer trace.Tracer, metrics *Metrics, backend, operation string,
+	attrs ...attribute.KeyValue) (context.Context, *backendRequest) {
+
+	ctx, span := tracer.Start(ctx, backend+" "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrBackend.String(backend)),
+		trace.WithAttributes(attrs...))
+	return ctx, &backendRequest{
+		span:      span,
+		metrics:   metrics,
+		backend:   backend,
+		operation: operation,
+		start:     time.Now(),
+	}
+}
+
+func (r *backendRequest) end(err error) {
+	r.metrics.observeBackendRequest(r.backend, r.operation, err, r.start)
+	endSpan(r.span, err)
+}
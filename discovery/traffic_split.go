@@ -0,0 +1,224 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// key under which traffic split rules are stored, relative to service namespace
+const trafficSplitKey = "trafficSplit"
+
+// TrafficSplitRule assigns a percentage of service discovery selections to a version range.
+type TrafficSplitRule struct {
+	// Version or version range, e.g. "2.1.0" or "2.0.x"
+	Version string
+	// Share of selections, relative to the sum of all rules' percentages
+	Percent int
+}
+
+// traffic split watches of a discovery source, one per discovered service
+type trafficSplitWatches struct {
+	mutex   sync.Mutex
+	watches []*trafficSplitWatch
+}
+
+type trafficSplitWatch struct {
+	namespace string
+
+	mutex sync.Mutex
+	rules []TrafficSplitRule
+}
+
+func (w *trafficSplitWatch) getRules() []TrafficSplitRule {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.rules
+}
+
+func (w *trafficSplitWatch) setRules(rules []TrafficSplitRule) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.rules = rules
+}
+
+// SetTrafficSplit stores traffic split rules for a service in an environment. Service discovery
+// spreads selections of the service across version ranges by given percentages, for example:
+//
+//	disc.SetTrafficSplit("prod", "customer-service", []discovery.TrafficSplitRule{
+//		{Version: "2.1.0", Percent: 5},
+//		{Version: "2.0.x", Percent: 95},
+//	})
+//
+// Rules are watched and changes are applied without restarting discovering services.
+func (d Util) SetTrafficSplit(environment, service string, rules []TrafficSplitRule) error {
+	value, err := formatTrafficSplit(rules)
+	if err != nil {
+		return err
+	}
+	key := serviceNamespace(environment, service) + "/" + trafficSplitKey
+	d.Logger.Info("Setting trafficSplit", F("key", key), F("traffic_split", value))
+	return d.discoverySource.SetKey(key, value)
+}
+
+// ClearTrafficSplit removes traffic split rules for a service in an environment.
+func (d Util) ClearTrafficSplit(environment, service string) error {
+	key := serviceNamespace(environment, service) + "/" + trafficSplitKey
+	d.Logger.Info("Clearing trafficSplit", F("key", key))
+	return d.discoverySource.DeleteKey(key)
+}
+
+// returns KV namespace of given service, e.g. /environments/dev/services/my-service
+func serviceNamespace(environment, service string) string {
+	return fmt.Sprintf("/environments/%s/services/%s", environment, service)
+}
+
+// rules are stored as comma-separated version:percent pairs, e.g. 2.1.0:5,2.0.x:95
+func formatTrafficSplit(rules []TrafficSplitRule) (string, error) {
+	var pairs []string
+	for _, r := range rules {
+		if _, err := parseVersion(r.Version); err != nil {
+			return "", fmt.Errorf("invalid traffic split version %s: %s", r.Version, err.Error())
+		}
+		if r.Percent < 0 {
+			return "", fmt.Errorf("invalid traffic split percent %d for version %s", r.Percent, r.Version)
+		}
+		pairs = append(pairs, r.Version+":"+strconv.Itoa(r.Percent))
+	}
+	return strings.Join(pairs, ","), nil
+}
+
+func parseTrafficSplit(value string) ([]TrafficSplitRule, error) {
+	var rules []TrafficSplitRule
+	if strings.TrimSpace(value) == "" {
+		return rules, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid traffic split rule: %s", pair)
+		}
+		version := strings.TrimSpace(pair[:i])
+		percent, err := strconv.Atoi(strings.TrimSpace(pair[i+1:]))
+		if err != nil || percent < 0 {
+			return nil, fmt.Errorf("invalid traffic split percent: %s", pair)
+		}
+		if _, err := parseVersion(version); err != nil {
+			return nil, fmt.Errorf("invalid traffic split version %s: %s", version, err.Error())
+		}
+		rules = append(rules, TrafficSplitRule{Version: version, Percent: percent})
+	}
+	return rules, nil
+}
+
+// returns traffic split rules for given service, creating a watch if it does not exist yet
+func (ws *trafficSplitWatches) rules(watchKey keyWatcher, environment, service string, logger Logger) []TrafficSplitRule {
+	namespace := serviceNamespace(environment, service)
+
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	for _, w := range ws.watches {
+		if w.namespace == namespace {
+			// watch already set :)
+			return w.getRules()
+		}
+	}
+
+	logger.Info("Creating a trafficSplit watch", F("namespace", namespace))
+	w := &trafficSplitWatch{namespace: namespace}
+	initial := true
+	watchKey(namespace, trafficSplitKey, func(value string) {
+		if !initial {
+			logger.Info("Updated trafficSplit value", F("namespace", namespace), F("traffic_split", value))
+		}
+		initial = false
+		rules, err := parseTrafficSplit(value)
+		if err != nil {
+			logger.Warn("Ignoring trafficSplit value", F("namespace", namespace), errField(err))
+			rules = nil
+		}
+		w.setRules(rules)
+	})
+
+	ws.watches = append(ws.watches, w)
+	return w.getRules()
+}
+
+// picks a rule with probability proportional to its percent. If stickyKey is set, the same key
+// always picks the same rule (as long as rules do not change).
+func chooseTrafficSplitRule(rules []TrafficSplitRule, stickyKey string) (TrafficSplitRule, bool) {
+	total := 0
+	for _, r := range rules {
+		total += r.Percent
+	}
+	if total == 0 {
+		return TrafficSplitRule{}, false
+	}
+
+	var n int
+	if stickyKey != "" {
+		h := fnv.New32a()
+		h.Write([]byte(stickyKey))
+		n = int(h.Sum32() % uint32(total))
+	} else {
+		n = rand.Intn(total)
+	}
+
+	for _, r := range rules {
+		if n < r.Percent {
+			return r, true
+		}
+		n -= r.Percent
+	}
+	return TrafficSplitRule{}, false
+}
+
+// returns instances that match version range of a traffic split rule, picked from given rules.
+// If there are no rules or no instance matches the picked rule, all instances are returned.
+func applyTrafficSplit(instances []discoveredService, rules []TrafficSplitRule, stickyKey string) []discoveredService {
+	rule, ok := chooseTrafficSplitRule(rules, stickyKey)
+	if !ok {
+		return instances
+	}
+
+	ruleVersion, err := parseVersion(rule.Version)
+	if err != nil {
+		return instances
+	}
+
+	var matching []discoveredService
+	for _, instance := range instances {
+		if ruleVersion(instance.version) {
+			matching = append(matching, instance)
+		}
+	}
+	if len(matching) == 0 {
+		return instances
+	}
+	return matching
+}
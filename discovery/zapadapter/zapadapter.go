@@ -0,0 +1,65 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+// Package zapadapter adapts zap loggers to discovery.Logger.
+package zapadapter
+
+import (
+	"github.com/mc0239/kumuluzee-go-discovery/discovery"
+	"go.uber.org/zap"
+)
+
+// New returns a discovery.Logger that writes to given zap logger.
+func New(l *zap.Logger) discovery.Logger {
+	return logger{l}
+}
+
+type logger struct {
+	l *zap.Logger
+}
+
+func (l logger) Debug(msg string, fields ...discovery.Field) {
+	l.l.Debug(msg, zapFields(fields)...)
+}
+
+func (l logger) Info(msg string, fields ...discovery.Field) {
+	l.l.Info(msg, zapFields(fields)...)
+}
+
+func (l logger) Warn(msg string, fields ...discovery.Field) {
+	l.l.Warn(msg, zapFields(fields)...)
+}
+
+func (l logger) Error(msg string, fields ...discovery.Field) {
+	l.l.Error(msg, zapFields(fields)...)
+}
+
+func zapFields(fields []discovery.Field) []zap.Field {
+	zfs := make([]zap.Field, 0, len(fields))
+	for _, f := range fields {
+		if err, ok := f.Value.(error); ok {
+			zfs = append(zfs, zap.NamedError(f.Key, err))
+		} else {
+			zfs = append(zfs, zap.Any(f.Key, f.Value))
+		}
+	}
+	return zfs
+}
@@ -0,0 +1,65 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+// Package zerologadapter adapts zerolog loggers to discovery.Logger.
+package zerologadapter
+
+import (
+	"github.com/mc0239/kumuluzee-go-discovery/discovery"
+	"github.com/rs/zerolog"
+)
+
+// New returns a discovery.Logger that writes to given zerolog logger.
+func New(l zerolog.Logger) discovery.Logger {
+	return logger{l}
+}
+
+type logger struct {
+	l zerolog.Logger
+}
+
+func (l logger) Debug(msg string, fields ...discovery.Field) {
+	withFields(l.l.Debug(), fields).Msg(msg)
+}
+
+func (l logger) Info(msg string, fields ...discovery.Field) {
+	withFields(l.l.Info(), fields).Msg(msg)
+}
+
+func (l logger) Warn(msg string, fields ...discovery.Field) {
+	withFields(l.l.Warn(), fields).Msg(msg)
+}
+
+func (l logger) Error(msg string, fields ...discovery.Field) {
+	withFields(l.l.Error(), fields).Msg(msg)
+}
+
+// event is nil if its level is disabled, zerolog methods are no-ops on nil events
+func withFields(e *zerolog.Event, fields []discovery.Field) *zerolog.Event {
+	for _, f := range fields {
+		if err, ok := f.Value.(error); ok {
+			e = e.AnErr(f.Key, err)
+		} else {
+			e = e.Interface(f.Key, f.Value)
+		}
+	}
+	return e
+}